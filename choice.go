@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+// Choice prompts ask a question answered with a single key, the callback
+// gets the key pressed or 0 when the prompt is cancelled. The editor goes
+// back to the mode it was in before calling it.
+
+var (
+	choice_question      = ""
+	choice_keys          = []rune{}
+	choice_callback_fn   func(rune)
+	choice_previous_mode = "normal"
+)
+
+func init_choice() {
+	add_mode("choice")
+	bind("choice", k("C-c"), choice_cancel)
+	bind("choice", k("C-g"), choice_cancel)
+	bind("choice", k("ESC"), choice_cancel)
+	bind("choice", k("$any"), func(vt *view_tree, b *buffer, kl *key_list) {
+		kk := kl.keys[len(kl.keys)-1]
+		if kk.is_rune() && list_contains_rune(choice_keys, kk.chr) {
+			choice_answer(kk.chr)
+		}
+	})
+}
+
+func prompt_choice(question string, keys []rune, cb func(rune)) {
+	choice_question = question
+	choice_keys = keys
+	choice_callback_fn = cb
+	if editor_mode != "choice" {
+		choice_previous_mode = editor_mode
+	}
+	enter_mode("choice")
+}
+
+func yes_or_no(question string, cb func(bool)) {
+	prompt_choice(question, []rune("yn"), func(r rune) {
+		cb(r == 'y')
+	})
+}
+
+func choice_answer(r rune) {
+	cb := choice_callback_fn
+	choice_callback_fn = nil
+	enter_mode(choice_previous_mode)
+	if cb != nil {
+		cb(r)
+	}
+}
+
+func choice_cancel(vt *view_tree, b *buffer, kl *key_list) {
+	choice_answer(0)
+}
+
+// Text shown in the message bar while waiting for an answer
+func choice_prompt_text() string {
+	keys := []string{}
+	for _, r := range choice_keys {
+		keys = append(keys, string(r))
+	}
+	return choice_question + " [" + strings.Join(keys, "/") + "] "
+}
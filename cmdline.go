@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Command lines are split into arguments like a shell would: spaces separate
+// arguments unless quoted ('...' keeps it's contents as is, "..." still
+// expands variables) or escaped with a \.
+//
+// Outside of quotes % is the current buffer's path, # the alternate buffer's
+// and ~ at the beginning of an argument the home directory. $NAME and
+// ${NAME} are environment variables.
+
+// Commands parsing their arguments themselves (:s/a b/c/) get the rest of
+// the line after their name as is
+var raw_arg_commands = map[string]bool{}
+
+// Runs a command line, a range alone moves to it's last line
+func run_command_line(line string) {
+	b := current_view_tree.leaf.buf
+	r, rest, err := parse_range(b, line)
+	var args []string
+	if err == nil {
+		if name, ok := raw_arg_command_name(rest); ok {
+			args = []string{name, strings.TrimLeft(rest, " ")[len(name):]}
+		} else {
+			args, err = parse_command_line(rest)
+		}
+	}
+	if err != nil {
+		message_error(err.Error())
+		return
+	}
+	if len(args) == 0 && r != nil {
+		b.move_to(0, r.end)
+		return
+	}
+	run_command_range(r, args)
+}
+
+// Name at the start of a line (letters only) when it's command takes raw
+// arguments
+func raw_arg_command_name(line string) (string, bool) {
+	line = strings.TrimLeft(line, " ")
+	i := 0
+	for i < len(line) && is_alpha(rune(line[i])) {
+		i++
+	}
+	name := line[:i]
+	if full_name, ok := command_aliases[name]; ok {
+		return name, raw_arg_commands[full_name]
+	}
+	return name, raw_arg_commands[name]
+}
+
+func parse_command_line(line string) ([]string, error) {
+	args, _, err := split_command_line(line, false)
+	return args, err
+}
+
+// Splits a command line in arguments, also returning the index (in runes) of
+// the start of each. When typing, the line is still being typed: the last
+// argument is kept even if it's quote isn't closed, and is empty when the
+// line ends with a space.
+func split_command_line(line string, typing bool) ([]string, []int, error) {
+	args := []string{}
+	starts := []int{}
+	arg := []rune{}
+	in_arg := false
+	start := 0
+	quote := rune(0)
+	r := []rune(line)
+
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		if !in_arg {
+			start = i
+		}
+		switch {
+		case quote == '\'' && c != '\'':
+			arg = append(arg, c)
+		case c == quote:
+			quote = 0
+		case c == '\\' && i+1 < len(r) && (quote == 0 || r[i+1] == '"' || r[i+1] == '\\' || r[i+1] == '$'):
+			i++
+			arg = append(arg, r[i])
+			in_arg = true
+		case c == '$':
+			name, n := parse_env_name(r[i+1:])
+			if n == 0 {
+				arg = append(arg, c)
+			} else {
+				arg = append(arg, []rune(os.Getenv(name))...)
+				i += n
+			}
+			in_arg = true
+		case quote != 0:
+			arg = append(arg, c)
+		case c == '\'' || c == '"':
+			quote = c
+			in_arg = true
+		case unicode.IsSpace(c):
+			if in_arg {
+				args = append(args, string(arg))
+				starts = append(starts, start)
+				arg = []rune{}
+				in_arg = false
+			}
+		case c == '%' || c == '#':
+			path, err := command_line_file(c)
+			if err != nil {
+				return nil, nil, err
+			}
+			arg = append(arg, []rune(path)...)
+			in_arg = true
+		case c == '~' && !in_arg && (i+1 == len(r) || r[i+1] == '/'):
+			arg = append(arg, []rune(os.Getenv("HOME"))...)
+			in_arg = true
+		default:
+			arg = append(arg, c)
+			in_arg = true
+		}
+	}
+	if quote != 0 && !typing {
+		return nil, nil, errors.New("Missing closing " + string(quote))
+	}
+	if in_arg || typing {
+		if !in_arg {
+			start = len(r)
+		}
+		args = append(args, string(arg))
+		starts = append(starts, start)
+	}
+	return args, starts, nil
+}
+
+// Escapes the chars of an argument that would otherwise be expanded or split
+// it
+func escape_command_arg(arg string) string {
+	escaped := []rune{}
+	for i, c := range []rune(arg) {
+		if unicode.IsSpace(c) || strings.ContainsRune("\\'\"%#$", c) || c == '~' && i == 0 {
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, c)
+	}
+	return string(escaped)
+}
+
+// Name of the variable at the start of r (after a $) and the number of runes
+// it takes
+func parse_env_name(r []rune) (string, int) {
+	if len(r) > 0 && r[0] == '{' {
+		for i := 1; i < len(r); i++ {
+			if r[i] == '}' {
+				return string(r[1:i]), i + 1
+			}
+		}
+		return "", 0
+	}
+	n := 0
+	for n < len(r) && (r[n] == '_' || is_alpha(r[n]) || is_num(r[n])) {
+		n++
+	}
+	return string(r[:n]), n
+}
+
+// Path of the current (%) or alternate (#) buffer, relative to the working
+// directory when under it
+func command_line_file(c rune) (string, error) {
+	b := current_view_tree.leaf.buf
+	if c == '#' {
+		if b = current_view_tree.alternate_buffer(); b == nil {
+			return "", errors.New("No alternate file name to substitute for '#'")
+		}
+	}
+	if b.path == "" {
+		return "", errors.New("No file name to substitute for '" + string(c) + "'")
+	}
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, b.path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel, nil
+		}
+	}
+	return b.path, nil
+}
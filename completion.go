@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// In prompt mode TAB completes the last word of the line using the prompt's
+// completion function, pressing it again (or S-TAB) cycles through the
+// candidates listed in the menu shown above the message bar.
+//
+// The command line completes command names and aliases, then the argument
+// with the completion function added for the command.
+
+var (
+	completion_items    = []string{}
+	completion_index    = -1
+	command_completions = map[string]func(string) []string{}
+)
+
+func init_completion() {
+	bind("prompt", k("TAB"), func(vt *view_tree, b *buffer, kl *key_list) {
+		completion_next(1)
+	})
+	bind("prompt", k("S-TAB"), func(vt *view_tree, b *buffer, kl *key_list) {
+		completion_next(-1)
+	})
+
+	for _, name := range []string{"edit", "write", "split", "vsplit", "tabnew"} {
+		add_command_completion(name, complete_file)
+	}
+	add_command_completion("buffers", complete_buffer)
+	add_command_completion("set", complete_option)
+}
+
+func add_command_completion(name string, f func(string) []string) {
+	command_completions[name] = f
+}
+
+func completion_clear() {
+	completion_items = []string{}
+	completion_index = -1
+}
+
+func completion_next(n int) {
+	if len(completion_items) == 0 {
+		if editor_prompt_completion_fn == nil {
+			return
+		}
+		completion_items = editor_prompt_completion_fn(editor_prompt_value)
+		if len(completion_items) == 0 {
+			return
+		}
+		if n < 0 {
+			completion_index = 0
+		}
+	}
+	count := len(completion_items)
+	completion_index = ((completion_index+n)%count + count) % count
+
+	// Replace the argument being typed, quoted or escaped as it may be
+	_, starts, err := split_command_line(editor_prompt_value, true)
+	if err != nil {
+		return
+	}
+	start := []rune(editor_prompt_value)[:starts[len(starts)-1]]
+	prompt_set_value(string(start) + escape_command_arg(completion_items[completion_index]))
+	// A single candidate is simply inserted
+	if count == 1 {
+		completion_clear()
+	}
+}
+
+// Candidates for the last word of a command line
+func complete_command(line string) []string {
+	args, _, err := split_command_line(line, true)
+	if err != nil {
+		return []string{}
+	}
+	if len(args) == 1 {
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		for alias := range command_aliases {
+			names = append(names, alias)
+		}
+		return complete_from(names, args[0])
+	}
+	name := args[0]
+	if full_name, ok := command_aliases[name]; ok {
+		name = full_name
+	}
+	if f, ok := command_completions[name]; ok {
+		return f(args[len(args)-1])
+	}
+	return []string{}
+}
+
+// Sorted words of the list starting with prefix
+func complete_from(list []string, prefix string) []string {
+	matches := []string{}
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) {
+			matches = append(matches, s)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// Files in the directory of the path given, directories end with a /
+func complete_file(prefix string) []string {
+	dir, base := filepath.Split(prefix)
+	read_dir := dir
+	if read_dir == "" {
+		read_dir = "."
+	} else if strings.HasPrefix(read_dir, "~/") {
+		read_dir = filepath.Join(os.Getenv("HOME"), read_dir[2:])
+	}
+	files, err := ioutil.ReadDir(read_dir)
+	if err != nil {
+		return []string{}
+	}
+	names := []string{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		name := dir + f.Name()
+		if f.IsDir() {
+			name += string(filepath.Separator)
+		}
+		names = append(names, name)
+	}
+	return complete_from(names, prefix)
+}
+
+func complete_buffer(prefix string) []string {
+	names := []string{}
+	for _, b := range buffers {
+		names = append(names, b.name)
+	}
+	return complete_from(names, prefix)
+}
+
+func complete_option(prefix string) []string {
+	names := []string{}
+	for name := range config {
+		names = append(names, name)
+	}
+	return complete_from(names, prefix)
+}
+
+// Renders the candidates on row y, scrolled to show the selected one
+func render_completion_menu(y, width int) {
+	s := style("completion")
+	write(s, 0, y, strings.Repeat(" ", width))
+
+	first := 0
+	for {
+		w := 0
+		if first > 0 {
+			w = 2
+		}
+		for _, item := range completion_items[first : completion_index+1] {
+			w += len([]rune(item)) + 2
+		}
+		if w <= width || first == completion_index {
+			break
+		}
+		first++
+	}
+
+	x := 0
+	if first > 0 {
+		x += write(s, x, y, "< ")
+	}
+	for i := first; i < len(completion_items); i++ {
+		item := " " + completion_items[i] + " "
+		if x+len([]rune(item)) > width {
+			write(s, width-1, y, ">")
+			break
+		}
+		if i == completion_index {
+			x += write(style("completion.current"), x, y, item)
+		} else {
+			x += write(s, x, y, item)
+		}
+	}
+}
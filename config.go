@@ -1,14 +1,34 @@
 package main
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 var (
 	config map[string]interface{}
 )
 
 func init_config() {
 	config = map[string]interface{}{
-		"tab_width":     float64(4),
-		"tab_to_spaces": true,
+		"tab_width":             float64(4),
+		"tab_to_spaces":         true,
+		"undo_levels":           float64(1000),
+		"undo_file":             true,
+		"switch_to_open_window": false,
+		"wrap":                  false,
+		"wrap_indicator":        "↪ ",
+		"wrap_at_word":          false,
+		"number":                true,
+		"relativenumber":        false,
+		"sign_column":           "auto",
+		"message_history":       float64(1000),
+		"history_size":          float64(100),
+		"status_line":           "{mode} {name}{modified}{=}{selection} {search} {keys} ({col},{line}) {lines} ",
 	}
+
+	add_command("set", command_set)
 }
 
 func config_get(key string, b *buffer) string {
@@ -41,3 +61,41 @@ func config_get_number(key string, b *buffer) float64 {
 func config_set(key string, value interface{}) {
 	config[key] = value
 }
+
+// set <option> <value?> changes an option, parsing the value according to
+// the option's type, or shows it's value when none is given
+func command_set(r *ex_range, args []string) {
+	if len(args) < 2 || args[1] == "" {
+		message_error("No option given")
+		return
+	}
+	key := args[1]
+	old, ok := config[key]
+	if !ok {
+		message_error("No option named '" + key + "'")
+		return
+	}
+	if len(args) < 3 {
+		message(fmt.Sprintf("%s %v", key, old))
+		return
+	}
+	value := strings.Join(args[2:], " ")
+	switch old.(type) {
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			message_error("Option '" + key + "' needs true or false")
+			return
+		}
+		config_set(key, b)
+	case float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			message_error("Option '" + key + "' needs a number")
+			return
+		}
+		config_set(key, n)
+	default:
+		config_set(key, value)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strconv"
+)
+
+// The gutter left of the text holds the sign column and line numbers.
+//
+// Signs are one char markers any part of the editor can put on a buffer's
+// lines (errors, search matches...), each under it's own group name so that
+// it can clear and place them again without touching the others. The sign
+// column is shown when the buffer has signs, always or never depending on the
+// sign_column option ("auto", "yes" or "no").
+//
+// The number and relativenumber options choose the line numbers shown, with
+// both the current line shows it's number and the others their distance to
+// it. With neither, no numbers are shown.
+
+type sign struct {
+	line  int
+	text  rune
+	style string
+}
+
+var signs = map[*buffer]map[string][]*sign{}
+
+func sign_place(b *buffer, group string, line int, text rune, style_name string) {
+	if signs[b] == nil {
+		signs[b] = map[string][]*sign{}
+	}
+	signs[b][group] = append(signs[b][group], &sign{line: line, text: text, style: style_name})
+}
+
+func sign_clear(b *buffer, group string) {
+	if signs[b] != nil {
+		delete(signs[b], group)
+	}
+}
+
+// Moves signs with their lines after text from beg to end was inserted (or
+// removed), signs of removed lines are dropped. When whole lines are
+// inserted or removed at the start of beg's line (O, dd) beg's line moves
+// too, otherwise only the lines after it.
+func sign_shift(b *buffer, beg, end *location, removed bool) {
+	n := end.line - beg.line
+	if n == 0 {
+		return
+	}
+	if removed {
+		n = -n
+	}
+	first := beg.line + 1
+	if beg.char == 0 && end.char == 0 {
+		first = beg.line
+	}
+	for name, group := range signs[b] {
+		kept := []*sign{}
+		for _, s := range group {
+			if s.line >= first && s.line < first-n {
+				continue
+			}
+			if s.line >= first {
+				s.line += n
+			}
+			kept = append(kept, s)
+		}
+		signs[b][name] = kept
+	}
+}
+
+// Last sign placed on a line, nil if there are none
+func sign_at(b *buffer, line int) *sign {
+	var found *sign
+	for _, group := range signs[b] {
+		for _, s := range group {
+			if s.line == line {
+				found = s
+			}
+		}
+	}
+	return found
+}
+
+func (v *view) show_signs() bool {
+	switch config_get("sign_column", v.buf) {
+	case "yes":
+		return true
+	case "no":
+		return false
+	}
+	for _, group := range signs[v.buf] {
+		if len(group) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *view) show_numbers() bool {
+	return config_get_bool("number", v.buf) || config_get_bool("relativenumber", v.buf)
+}
+
+func (v *view) gutter_width() int {
+	w := 0
+	if v.show_signs() {
+		w++
+	}
+	if v.show_numbers() {
+		w += len(strconv.Itoa(v.buf.line_count())) + 1
+	}
+	return w
+}
+
+func (v *view) line_number_label(l int) string {
+	if !config_get_bool("relativenumber", v.buf) ||
+		l == v.cursor.line && config_get_bool("number", v.buf) {
+		return strconv.Itoa(l + 1)
+	}
+	if l < v.cursor.line {
+		return strconv.Itoa(v.cursor.line - l)
+	}
+	return strconv.Itoa(l - v.cursor.line)
+}
+
+func render_gutter(v *view, x, y, line int) {
+	if v.show_signs() {
+		if s := sign_at(v.buf, line); s != nil {
+			write(style(s.style), x, y, string(s.text))
+		}
+		x++
+	}
+	if v.show_numbers() {
+		st := style("linenumber")
+		if line == v.cursor.line {
+			st = style("linenumber.current")
+		}
+		width := len(strconv.Itoa(v.buf.line_count()))
+		write(st, x, y, padl(v.line_number_label(line), width, ' '))
+	}
+}
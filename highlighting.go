@@ -35,6 +35,7 @@ func highlight_buffer(b *buffer) {
 	s := style("default")
 	ss := style("special")
 	sse := style("search")
+	ssu := style("substitute")
 	svi := style("visual")
 	sts := style("text.string")
 	stn := style("text.number")
@@ -42,16 +43,17 @@ func highlight_buffer(b *buffer) {
 	str := style("text.reserved")
 	stsp := style("text.special")
 
-	style_map := make([][]tcell.Style, len(b.data))
+	style_map := make([][]tcell.Style, b.line_count())
 	in_string := rune(0)
-	for l := range b.data {
+	for l := range style_map {
+		line := b.get_line(l)
 		in_line_comment := false
 		word := ""
-		style_map[l] = make([]tcell.Style, len(b.data[l])+1)
-		for c, char := range b.data[l] {
+		style_map[l] = make([]tcell.Style, len(line)+1)
+		for c, char := range line {
 			prev_char := rune(0)
 			if c > 0 {
-				prev_char = b.data[l][c-1]
+				prev_char = line[c-1]
 			}
 
 			// for numbers
@@ -73,6 +75,10 @@ func highlight_buffer(b *buffer) {
 					}
 				}
 			}
+			if substitute_highlight(b, l, c) {
+				style_map[l][c] = ssu
+				continue
+			}
 			if visual_highlight(b, l, c) {
 				style_map[l][c] = svi
 				continue
@@ -81,7 +87,7 @@ func highlight_buffer(b *buffer) {
 				style_map[l][c] = stc
 				continue
 			}
-			if in_string > 0 && c-1 > 0 && b.data[l][c-1] == '\\' && (c-2 < 0 || b.data[l][c-2] != '\\') {
+			if in_string > 0 && c-1 > 0 && line[c-1] == '\\' && (c-2 < 0 || line[c-2] != '\\') {
 				style_map[l][c] = sts
 				continue
 			}
@@ -103,17 +109,17 @@ func highlight_buffer(b *buffer) {
 			}
 			if in_string > 0 {
 				style_map[l][c] = sts
-			} else if list_contains_string(highlighting_special_words, word) && c+1 < len(b.data[l]) && !is_word(b.data[l][c+1]) {
+			} else if list_contains_string(highlighting_special_words, word) && c+1 < len(line) && !is_word(line[c+1]) {
 				for i := len(word) - 1; i >= 0; i-- {
 					style_map[l][c-i] = stsp
 				}
-			} else if list_contains_string(highlighting_reserved_words, word) && c+1 < len(b.data[l]) && !is_word(b.data[l][c+1]) {
+			} else if list_contains_string(highlighting_reserved_words, word) && c+1 < len(line) && !is_word(line[c+1]) {
 				for i := len(word) - 1; i >= 0; i-- {
 					style_map[l][c-i] = str
 				}
 			} else if !passed_alpha && is_num(char) {
 				style_map[l][c] = stn
-			} else if strings.ContainsRune(special_chars, b.data[l][c]) {
+			} else if strings.ContainsRune(special_chars, line[c]) {
 				style_map[l][c] = ss
 			} else {
 				style_map[l][c] = s
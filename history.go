@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Each prompt (":" for commands, "/" for searches...) has it's own history
+// of entered lines, UP and DOWN go through the ones starting with what was
+// typed before. Histories are kept in ~/.ry/history.json between sessions,
+// up to history_size lines each.
+
+var (
+	prompt_histories      = map[string][]string{}
+	prompt_history_index  = 0
+	prompt_history_prefix = ""
+	prompt_history_loaded = false
+)
+
+func prompt_history_path() string {
+	return filepath.Join(os.Getenv("HOME"), ".ry", "history.json")
+}
+
+func prompt_history_load() {
+	prompt_history_loaded = true
+	data, err := ioutil.ReadFile(prompt_history_path())
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &prompt_histories); err != nil {
+		message_error("Error reading history: " + err.Error())
+	}
+}
+
+func prompt_history_save() {
+	data, err := json.Marshal(prompt_histories)
+	if err == nil {
+		path := prompt_history_path()
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = ioutil.WriteFile(path, data, 0644)
+		}
+	}
+	if err != nil {
+		message_error("Error writing history: " + err.Error())
+	}
+}
+
+func prompt_history_start(name string) {
+	if !prompt_history_loaded {
+		prompt_history_load()
+	}
+	prompt_history_index = len(prompt_histories[name])
+	prompt_history_prefix = ""
+}
+
+// Adds a line at the end of the history, moving it there if it was already
+// in it
+func prompt_history_add(name, line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	history := []string{}
+	for _, l := range prompt_histories[name] {
+		if l != line {
+			history = append(history, l)
+		}
+	}
+	history = append(history, line)
+	if size := int(config_get_number("history_size", nil)); len(history) > size {
+		history = history[len(history)-size:]
+	}
+	prompt_histories[name] = history
+	prompt_history_save()
+}
+
+// Goes to the previous (n < 0) or next line in the history starting with
+// what was typed, past the last one goes back to the typed text
+func prompt_history_move(n int) command_fn {
+	return func(vt *view_tree, b *buffer, kl *key_list) {
+		history := prompt_histories[editor_prompt]
+		if prompt_history_index == len(history) {
+			prompt_history_prefix = editor_prompt_value
+		}
+		for i := prompt_history_index + n; i >= 0 && i <= len(history); i += n {
+			if i == len(history) {
+				prompt_history_index = i
+				prompt_set_value(prompt_history_prefix)
+				break
+			}
+			if strings.HasPrefix(history[i], prompt_history_prefix) {
+				prompt_history_index = i
+				prompt_set_value(history[i])
+				break
+			}
+		}
+		completion_clear()
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
+import (
+	"strings"
+)
+
 var (
-	hooks_buffer map[string][]func(*buffer)
+	hooks_buffer         map[string][]func(*buffer)
+	hooks_status_segment map[string][]status_segment_fn
 )
 
 func hook_buffer(name string, f func(*buffer)) {
@@ -19,12 +24,35 @@ func hook_trigger_buffer(name string, b *buffer) {
 	}
 }
 
+// Adds text to a status line segment, the texts of every hook of a segment
+// are joined by spaces
+func hook_status_segment(name string, f status_segment_fn) {
+	hooks_status_segment[name] = append(hooks_status_segment[name], f)
+}
+
+// Text of a segment, false when no hook provides it
+func hook_trigger_status_segment(name string, v *view) (string, bool) {
+	hooks, ok := hooks_status_segment[name]
+	if !ok {
+		return "", false
+	}
+	texts := []string{}
+	for _, f := range hooks {
+		if text := f(v); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, " "), true
+}
+
 func init_hooks() {
 	hooks_buffer = map[string][]func(*buffer){}
+	hooks_status_segment = map[string][]status_segment_fn{}
 
 	hook_buffer("moved", func(b *buffer) {
 		if current_view_tree.leaf.buf == b {
-			current_view_tree.leaf.adjust_scroll(b.last_render_width, b.last_render_height)
+			v := current_view_tree.leaf
+			v.adjust_scroll(v.last_render_width, v.last_render_height)
 		}
 	})
 }
@@ -0,0 +1,90 @@
+package main
+
+// q{reg} records every key typed into a register until q is typed again,
+// @{reg} types them again. Registers hold the keys as text (i f o o ESC) so
+// they can be pasted and edited like any other register.
+
+var (
+	// Register being recorded into, 0 when not recording
+	macro_recording_register rune = 0
+	macro_recorded_keys           = []*key{}
+	macro_last_register      rune = 0
+	// Number of macros being replayed, one can call another
+	macro_depth = 0
+)
+
+const macro_max_depth = 100
+
+func init_macros() {
+	bind("normal", k("q"), command_macro_record)
+	add_mode("macro-register")
+	bind("macro-register", k("$any"), command_macro_record_start)
+	bind("normal", k("@ $any"), command_macro_replay)
+}
+
+func macro_record_key(kk *key) {
+	if macro_recording_register == 0 || macro_depth > 0 || change_replaying {
+		return
+	}
+	macro_recorded_keys = append(macro_recorded_keys, kk)
+}
+
+// Only letters, the numbered registers hold deletes
+func is_macro_register(r rune) bool {
+	return is_alpha(r)
+}
+
+func command_macro_record(vt *view_tree, b *buffer, kl *key_list) {
+	if macro_recording_register == 0 {
+		enter_mode("macro-register")
+		return
+	}
+
+	// Drop the q that stopped the recording
+	keys := macro_recorded_keys
+	if len(keys) > 0 {
+		keys = keys[:len(keys)-1]
+	}
+	clipboard_set(macro_recording_register, []rune((&key_list{keys: keys}).String()))
+	macro_recording_register = 0
+	macro_recorded_keys = []*key{}
+}
+
+func command_macro_record_start(vt *view_tree, b *buffer, kl *key_list) {
+	enter_mode("normal")
+	r := kl.keys[len(kl.keys)-1]
+	if !r.is_rune() || !is_macro_register(r.chr) {
+		return
+	}
+	macro_recording_register = r.chr
+	macro_recorded_keys = []*key{}
+}
+
+func command_macro_replay(vt *view_tree, b *buffer, kl *key_list) {
+	r := kl.keys[len(kl.keys)-1].chr
+	if r == '@' {
+		if macro_last_register == 0 {
+			message_error("No previous macro")
+			return
+		}
+		r = macro_last_register
+	}
+	if !is_macro_register(r) {
+		message_error("Invalid register: " + string(r))
+		return
+	}
+	if macro_depth >= macro_max_depth {
+		message_error("Macro calls itself too many times")
+		return
+	}
+	macro_last_register = r
+
+	keys := k(string(clipboard_get(r))).keys
+	// The changes made by the macro are what . repeats, not @ itself
+	change_keys = nil
+	macro_depth++
+	defer func() { macro_depth-- }()
+	for i := 0; i < kl.times(); i++ {
+		feed_keys(keys)
+	}
+}
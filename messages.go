@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Every message shown in the echo area is also kept in a log, with it's time
+// and level, the :messages command shows it in the *messages* buffer. Debug
+// messages are only logged.
+
+const (
+	message_level_debug   = "debug"
+	message_level_info    = "info"
+	message_level_warning = "warning"
+	message_level_error   = "error"
+)
+
+type logged_message struct {
+	time  time.Time
+	level string
+	text  string
+}
+
+var messages_log = []*logged_message{}
+
+func init_messages() {
+	add_command("messages", command_messages)
+	add_alias("mes", "messages")
+
+	add_mode("messages")
+	bind("messages", k("q"), func(vt *view_tree, b *buffer, kl *key_list) {
+		close_current_buffer(true)
+	})
+}
+
+func message_log(level, m string) {
+	if m == "" {
+		return
+	}
+	messages_log = append(messages_log, &logged_message{time.Now(), level, m})
+	if max_messages := int(config_get_number("message_history", nil)); max_messages > 0 && len(messages_log) > max_messages {
+		messages_log = messages_log[len(messages_log)-max_messages:]
+	}
+}
+
+func message_at_level(level, m string) {
+	message_log(level, m)
+	if level == message_level_debug {
+		return
+	}
+	editor_message = m
+	editor_message_type = level
+}
+
+func message_warning(m string) {
+	message_at_level(message_level_warning, m)
+}
+
+func message_debug(m string) {
+	message_at_level(message_level_debug, m)
+}
+
+func command_messages(r *ex_range, args []string) {
+	lines := []string{}
+	for _, m := range messages_log {
+		prefix := m.time.Format("15:04:05") + " " + padr(m.level, 7, ' ') + " "
+		text := strings.Replace(m.text, "\n", "\n"+strings.Repeat(" ", len(prefix)), -1)
+		lines = append(lines, prefix+text)
+	}
+	if len(lines) == 0 {
+		message("No messages")
+		return
+	}
+
+	var b *buffer
+	if b = find_buffer("*messages*"); b == nil {
+		b = open_buffer_named("*messages*")
+		b.add_mode("messages")
+	}
+	b.set_contents(strings.Join(lines, "\n"))
+	hook_trigger_buffer("modified", b)
+	show_buffer(b.name)
+	b.move_to(0, b.line_count()-1)
+}
+
+// Lines the current message takes in the echo area, long messages are
+// wrapped and shown on up to half the screen
+func message_lines(width int) []string {
+	if editor_mode == "prompt" || editor_message == "" || width <= 0 {
+		return []string{editor_message}
+	}
+	lines := []string{}
+	for _, line := range strings.Split(editor_message, "\n") {
+		r := []rune(line)
+		for len(r) > width {
+			lines = append(lines, string(r[:width]))
+			r = r[width:]
+		}
+		lines = append(lines, string(r))
+	}
+	if max_lines := max(editor_height/2, 1); len(lines) > max_lines {
+		lines = lines[len(lines)-max_lines:]
+	}
+	return lines
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"strings"
+)
+
+// Operators (d, c, y, >, <) put the editor in operator-pending mode, the
+// next motion typed is then run and the text it moved over is handed to the
+// operator instead of just moving the cursor.
+
+type operator_fn func(vt *view_tree, b *buffer, r *char_range, linewise bool)
+
+type motion_kind int
+
+const (
+	// Range stops before the cursor position the motion lands on
+	motion_exclusive motion_kind = iota
+	// Range includes the char the motion lands on
+	motion_inclusive
+	// Range covers every line from the start to the end of the motion
+	motion_linewise
+)
+
+type operator struct {
+	keys string
+	f    operator_fn
+}
+
+var (
+	pending_operator       *operator = nil
+	pending_operator_count           = 1
+)
+
+func init_operators() {
+	add_operator("d", operator_delete)
+	add_operator("c", operator_change)
+	add_operator("y", operator_yank)
+	add_operator(">", operator_indent)
+	add_operator("<", operator_unindent)
+
+	bind("operator-pending", k("ESC"), operator_cancel)
+	bind("operator-pending", k("C-c"), operator_cancel)
+	bind("operator-pending", k("C-g"), operator_cancel)
+}
+
+// Binds a movement command in normal mode and as the target of operators in
+// operator-pending mode
+func bind_motion(keys string, kind motion_kind, f command_fn) {
+	bind("normal", k(keys), f)
+	bind("operator-pending", k(keys), func(vt *view_tree, b *buffer, kl *key_list) {
+		start := b.cursor.clone()
+		f(vt, b, operator_count_keys(kl))
+		beg, end := order_locations(start, b.cursor.clone())
+		operator_apply(vt, b, beg, end, kind)
+	})
+}
+
+// Binds an operator, typing it's key twice applies it to the current line
+func add_operator(keys string, f operator_fn) {
+	op := &operator{keys: keys, f: f}
+	bind("normal", k(keys), func(vt *view_tree, b *buffer, kl *key_list) {
+		pending_operator = op
+		pending_operator_count = kl.times()
+		enter_mode("operator-pending")
+	})
+	bind("operator-pending", k(keys), func(vt *view_tree, b *buffer, kl *key_list) {
+		if pending_operator != op {
+			operator_cancel(vt, b, kl)
+			return
+		}
+		end := new_location(b.cursor.line+operator_count_keys(kl).times()-1, 0)
+		operator_apply(vt, b, b.cursor.clone(), end, motion_linewise)
+	})
+}
+
+// Counts given to the operator and to the motion multiply (2 d 3 w deletes 6
+// words)
+func operator_count_keys(kl *key_list) *key_list {
+	if pending_operator_count <= 1 {
+		return kl
+	}
+	return &key_list{keys: kl.keys, count: pending_operator_count * kl.times()}
+}
+
+func operator_cancel(vt *view_tree, b *buffer, kl *key_list) {
+	pending_operator = nil
+	pending_operator_count = 1
+	register_pending = 0
+	enter_mode("normal")
+}
+
+// Runs the pending operator over the text between beg and end
+func operator_apply(vt *view_tree, b *buffer, beg, end *location, kind motion_kind) {
+	var r *char_range
+	switch kind {
+	case motion_linewise:
+		r = b.line_range(beg.line, end.line)
+	case motion_inclusive:
+		r = new_char_range(b.offset(beg), b.offset(end)+1)
+	default:
+		// An exclusive motion ending at the start of a line doesn't take the
+		// previous newline with it (d w on the last word of a line)
+		if end.line > beg.line && end.char == 0 {
+			end = new_location(end.line-1, len(b.get_line(end.line-1)))
+		}
+		r = new_char_range(b.offset(beg), b.offset(end))
+	}
+	operator_apply_range(vt, b, r, kind == motion_linewise)
+}
+
+// Runs the pending operator over a range of rune offsets
+func operator_apply_range(vt *view_tree, b *buffer, r *char_range, linewise bool) {
+	op := pending_operator
+	pending_operator = nil
+	pending_operator_count = 1
+	enter_mode("normal")
+	if op == nil {
+		return
+	}
+
+	r.end = min(r.end, b.text.length())
+	l, c := b.text.location(r.beg)
+	b.move_to(c, l)
+	b.begin_change_group()
+	op.f(vt, b, r, linewise)
+	b.end_change_group()
+}
+
+// Text of a range as it should be yanked, linewise text always ends with a
+// newline so it is pasted as whole lines
+func operator_range_text(b *buffer, r *char_range, linewise bool) []rune {
+	text := b.text.slice(r.beg, r.end)
+	if linewise && (len(text) == 0 || text[len(text)-1] != '\n') {
+		text = append(text, '\n')
+	}
+	return text
+}
+
+func operator_remove(b *buffer, r *char_range) []rune {
+	l, c := b.text.location(r.beg)
+	return b.remove_at(new_location(l, c), r.end-r.beg)
+}
+
+func operator_delete(vt *view_tree, b *buffer, r *char_range, linewise bool) {
+	register_delete(operator_range_text(b, r, linewise))
+	if linewise && r.end == b.text.length() && r.beg > 0 {
+		// Deleting the last lines, remove the newline before them instead
+		operator_remove(b, new_char_range(r.beg-1, r.end))
+		l, _ := b.text.location(r.beg - 1)
+		b.move_to(0, l)
+		return
+	}
+	operator_remove(b, r)
+	l, c := b.text.location(r.beg)
+	b.move_to(c, l)
+}
+
+func operator_change(vt *view_tree, b *buffer, r *char_range, linewise bool) {
+	register_delete(operator_range_text(b, r, linewise))
+	if linewise && r.end < b.text.length() {
+		// Keep the line itself, only clear it's contents
+		r.end--
+	}
+	operator_remove(b, r)
+	l, c := b.text.location(r.beg)
+	b.move_to(c, l)
+	enter_insert_mode(vt, b, nil)
+}
+
+func operator_yank(vt *view_tree, b *buffer, r *char_range, linewise bool) {
+	register_yank(operator_range_text(b, r, linewise))
+}
+
+func operator_range_lines(b *buffer, r *char_range) (int, int) {
+	l1, _ := b.text.location(r.beg)
+	l2, _ := b.text.location(max(r.end-1, r.beg))
+	return l1, l2
+}
+
+func operator_indent(vt *view_tree, b *buffer, r *char_range, linewise bool) {
+	indent := "\t"
+	if config_get_bool("tab_to_spaces", b) {
+		indent = strings.Repeat(" ", int(config_get_number("tab_width", b)))
+	}
+	l1, l2 := operator_range_lines(b, r)
+	for l := l1; l <= l2; l++ {
+		if len(b.get_line(l)) > 0 {
+			b.move_to(0, l)
+			b.insert([]rune(indent))
+		}
+	}
+	b.move_to(0, l1)
+}
+
+func operator_unindent(vt *view_tree, b *buffer, r *char_range, linewise bool) {
+	tab_width := int(config_get_number("tab_width", b))
+	l1, l2 := operator_range_lines(b, r)
+	for l := l1; l <= l2; l++ {
+		line := b.get_line(l)
+		n := 0
+		if len(line) > 0 && line[0] == '\t' {
+			n = 1
+		}
+		for n < len(line) && n < tab_width && line[n] == ' ' {
+			n++
+		}
+		if n > 0 {
+			b.remove_at(new_location(l, 0), n)
+		}
+	}
+	b.move_to(0, l1)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Progress reporters show how far a long running command is in the message
+// bar. Commands run before the next render so updates render the screen
+// themselves, at most every progress_min_time.
+
+const progress_min_time = 200 * time.Millisecond
+
+type progress_reporter struct {
+	message     string
+	min, max    int
+	value       int
+	last_render time.Time
+}
+
+func make_progress_reporter(message string, min, max int) *progress_reporter {
+	p := &progress_reporter{message: message, min: min, max: max, value: min}
+	p.show()
+	return p
+}
+
+func (p *progress_reporter) text() string {
+	if p.max <= p.min {
+		return p.message + "..."
+	}
+	percent := (p.value - p.min) * 100 / (p.max - p.min)
+	return p.message + "... " + strconv.Itoa(percent) + "%"
+}
+
+func (p *progress_reporter) show() {
+	editor_message = p.text()
+	editor_message_type = message_level_info
+	if screen != nil && time.Since(p.last_render) >= progress_min_time {
+		p.last_render = time.Now()
+		render()
+	}
+}
+
+func (p *progress_reporter) update(value int) {
+	p.value = max(min(value, p.max), p.min)
+	p.show()
+}
+
+func (p *progress_reporter) done() {
+	message(p.message + "...done")
+}
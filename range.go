@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Commands can be preceded by a range of lines they apply to (:10,20d). An
+// address is a line number, . (current line), $ (last line), 'x (mark x),
+// /pattern/ (next line matching) or ?pattern? (previous line matching),
+// followed by any number of +n / -n offsets. % is the whole buffer. With ;
+// instead of , the second address is relative to the first.
+//
+// Commands receive the range (nil when none was typed), range_or_line gives
+// the current line instead. Typing : in visual mode starts the line with
+// '<,'>, the selection's lines.
+
+type ex_range struct {
+	start, end int
+}
+
+func init_ranges() {
+	add_command("delete", command_range_delete)
+	add_alias("d", "delete")
+	add_command("yank", command_range_yank)
+	add_alias("y", "yank")
+}
+
+// The range given or the current line
+func range_or_line(r *ex_range, b *buffer) *ex_range {
+	if r == nil {
+		return &ex_range{b.cursor.line, b.cursor.line}
+	}
+	return r
+}
+
+// Starts a command line over the lines of the visual selection, marked '<
+// and '>
+func visual_mode_command(vt *view_tree, b *buffer, kl *key_list) {
+	cursor := b.cursor.clone()
+	_, l1, l2 := visual_mode_selection(b)
+	start, end := l1.line, l2.line
+	b.move_to(0, start)
+	mark_create('<', b)
+	b.move_to(0, end)
+	mark_create('>', b)
+	b.move_to(cursor.char, cursor.line)
+	exit_visual_mode(vt, b, kl)
+	prompt_command(vt, b, kl)
+	prompt_set_value("'<,'>")
+}
+
+// Parses the range at the beginning of a command line, returning it (nil
+// when there is none) and the rest of the line
+func parse_range(b *buffer, line string) (*ex_range, string, error) {
+	s := []rune(strings.TrimLeft(line, " :"))
+	if len(s) > 0 && s[0] == '%' {
+		return &ex_range{0, b.line_count() - 1}, string(s[1:]), nil
+	}
+
+	cur := b.cursor.line
+	start, n, err := parse_address(b, s, cur)
+	if err != nil {
+		return nil, "", err
+	}
+	if n == 0 {
+		return nil, string(s), nil
+	}
+	s = s[n:]
+	end := start
+	if len(s) > 0 && (s[0] == ',' || s[0] == ';') {
+		if s[0] == ';' {
+			cur = start
+		}
+		s = s[1:]
+		if end, n, err = parse_address(b, s, cur); err != nil {
+			return nil, "", err
+		} else if n == 0 {
+			end = cur
+		}
+		s = s[n:]
+	}
+
+	if start < 0 || end < 0 || start >= b.line_count() || end >= b.line_count() {
+		return nil, "", errors.New("Invalid range")
+	}
+	if start > end {
+		start, end = end, start
+	}
+	return &ex_range{start, end}, string(s), nil
+}
+
+// Parses an address, returning it's line and the number of runes it took
+// (0 when s doesn't start with one)
+func parse_address(b *buffer, s []rune, cur int) (int, int, error) {
+	line, i := cur, 0
+	switch {
+	case len(s) == 0:
+		return cur, 0, nil
+	case is_num(s[0]):
+		for i < len(s) && is_num(s[i]) {
+			i++
+		}
+		line, _ = strconv.Atoi(string(s[:i]))
+		line--
+	case s[0] == '.':
+		i = 1
+	case s[0] == '$':
+		line, i = b.line_count()-1, 1
+	case s[0] == '\'':
+		if len(s) < 2 {
+			return 0, 0, errors.New("Missing mark name")
+		}
+		m := get_mark(s[1])
+		if m == nil || m.buffer_name != b.name {
+			return 0, 0, errors.New("Mark '" + string(s[1]) + "' not set")
+		}
+		line, i = m.loc.line, 2
+	case s[0] == '/' || s[0] == '?':
+		end := 1
+		for end < len(s) && s[end] != s[0] {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		pattern := string(s[1:min(end, len(s))])
+		found, err := search_line(b, pattern, cur, s[0] == '?')
+		if err != nil {
+			return 0, 0, err
+		}
+		line, i = found, min(end+1, len(s))
+	}
+
+	// Offsets
+	for i < len(s) && (s[i] == '+' || s[i] == '-') {
+		sign := 1
+		if s[i] == '-' {
+			sign = -1
+		}
+		i++
+		j := i
+		for j < len(s) && is_num(s[j]) {
+			j++
+		}
+		n := 1
+		if j > i {
+			n, _ = strconv.Atoi(string(s[i:j]))
+		}
+		line += sign * n
+		i = j
+	}
+	return line, i, nil
+}
+
+// Next (or previous) line after cur matching pattern, wrapping around the
+// buffer. An empty pattern uses the last search.
+func search_line(b *buffer, pattern string, cur int, backwards bool) (int, error) {
+	if pattern == "" {
+		pattern = last_search
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return 0, err
+	}
+	count := b.line_count()
+	for i := 1; i <= count; i++ {
+		l := (cur + i) % count
+		if backwards {
+			l = ((cur-i)%count + count) % count
+		}
+		if re.MatchString(string(b.get_line(l))) {
+			return l, nil
+		}
+	}
+	return 0, errors.New("Pattern not found: " + pattern)
+}
+
+// Lines of a range as a rune range
+func (r *ex_range) char_range(b *buffer) *char_range {
+	cr := b.line_range(r.start, r.end)
+	cr.end = min(cr.end, b.text.length())
+	return cr
+}
+
+// Register given as the first argument (:d a)
+func range_command_register(args []string) {
+	if len(args) > 1 && len([]rune(args[1])) == 1 && is_register([]rune(args[1])[0]) {
+		register_pending = []rune(args[1])[0]
+	}
+}
+
+func command_range_delete(r *ex_range, args []string) {
+	b := current_view_tree.leaf.buf
+	range_command_register(args)
+	b.begin_change_group()
+	operator_delete(current_view_tree, b, range_or_line(r, b).char_range(b), true)
+	b.end_change_group()
+}
+
+func command_range_yank(r *ex_range, args []string) {
+	b := current_view_tree.leaf.buf
+	range_command_register(args)
+	operator_yank(current_view_tree, b, range_or_line(r, b).char_range(b), true)
+}
+
+// Writes the lines of the range to another file, asking before overwriting
+// an existing one
+func write_range(b *buffer, r *ex_range, path string) {
+	lines := []string{}
+	for l := r.start; l <= r.end; l++ {
+		lines = append(lines, string(b.get_line(l)))
+	}
+	name := path
+	if abs_path, err := filepath.Abs(path); err == nil {
+		path = abs_path
+	}
+	if _, err := os.Stat(path); err == nil {
+		yes_or_no("Overwrite '"+name+"'?", func(yes bool) {
+			if yes {
+				write_lines(path, lines)
+			}
+		})
+		return
+	}
+	write_lines(path, lines)
+}
+
+func write_lines(path string, lines []string) {
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0666); err != nil {
+		message_error("Error writing lines: " + err.Error())
+		return
+	}
+	message(plural(len(lines), "line") + " written to '" + path + "'")
+}
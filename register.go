@@ -0,0 +1,108 @@
+package main
+
+// Typing " and a register name before a yank, delete or paste makes it use
+// that register instead of the default one (" a y y, " a p). Uppercase names
+// append to the lowercase register.
+//
+// Deleted text is also kept in the numbered registers, " 1 has the last
+// deleted text and older ones are shifted up to " 9, deletes within a line go
+// to " - instead. " 0 has the last yanked text.
+//
+// The last inserted text (" .), last command (" :), current file name (" %)
+// and last search (" /) can be pasted but not written to.
+
+const register_small_delete = '-'
+
+var (
+	// Register selected for the next yank, delete or paste
+	register_pending   rune = 0
+	last_inserted_text      = []rune{}
+	last_command            = ""
+)
+
+func init_registers() {
+	bind("normal", k("\" $any"), command_select_register)
+}
+
+func is_register(r rune) bool {
+	return is_alpha(r) || is_num(r) || r == '"' || r == register_small_delete ||
+		is_read_only_register(r)
+}
+
+func is_read_only_register(r rune) bool {
+	return r == '.' || r == ':' || r == '%' || r == '/'
+}
+
+func command_select_register(vt *view_tree, b *buffer, kl *key_list) {
+	r := kl.keys[len(kl.keys)-1]
+	if !r.is_rune() || !is_register(r.chr) {
+		message_error("Invalid register: " + r.String())
+		return
+	}
+	register_pending = r.chr
+}
+
+// Returns the register selected for this command, the default one when none
+// was, and clears it
+func register_take() rune {
+	r := register_pending
+	register_pending = 0
+	if r == 0 || r == '"' {
+		return default_clipboard
+	}
+	return r
+}
+
+func register_yank(text []rune) {
+	r := register_take()
+	if is_read_only_register(r) {
+		message_error("Register " + string(r) + " is read-only")
+		return
+	}
+	if r == default_clipboard {
+		clipboards['0'] = text
+	} else {
+		clipboard_set(r, text)
+		text = clipboard_get(r)
+	}
+	clipboard_set(default_clipboard, text)
+}
+
+func register_delete(text []rune) {
+	r := register_take()
+	if is_read_only_register(r) {
+		message_error("Register " + string(r) + " is read-only")
+		return
+	}
+	if r != default_clipboard {
+		clipboard_set(r, text)
+		text = clipboard_get(r)
+	} else if list_contains_rune(text, '\n') {
+		for i := '9'; i > '1'; i-- {
+			if value, ok := clipboards[i-1]; ok {
+				clipboards[i] = value
+			}
+		}
+		clipboards['1'] = text
+	} else {
+		clipboards[register_small_delete] = text
+	}
+	clipboard_set(default_clipboard, text)
+}
+
+// Value of the registers that aren't stored in clipboards
+func register_read_only_value(r rune) []rune {
+	switch r {
+	case '.':
+		return last_inserted_text
+	case ':':
+		return []rune(last_command)
+	case '%':
+		if path, err := command_line_file('%'); err == nil {
+			return []rune(path)
+		}
+	case '/':
+		return []rune(last_search)
+	}
+	return []rune{}
+}
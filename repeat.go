@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gdamore/tcell"
+)
+
+// The keys of the last command that changed a buffer are kept so that . can
+// replay them, count and text typed in insert mode included.
+
+var (
+	// Incremented by every edit made through buffer.insert and
+	// buffer.remove_at (not by undo and redo)
+	change_tick = 0
+
+	last_change_keys []*key = nil
+	// Same keys without the counts typed, replayed after the count given
+	// to .
+	last_change_uncounted_keys []*key = nil
+
+	// Keys of the command being typed, nil between commands
+	change_keys           []*key = nil
+	change_uncounted_keys []*key = nil
+	change_tick_start            = 0
+	change_repeatable            = true
+	change_replaying             = false
+)
+
+func init_repeat() {
+	bind("normal", k("."), command_repeat_change)
+}
+
+func change_record_key(kk *key) {
+	if change_replaying {
+		return
+	}
+	if change_keys == nil {
+		change_keys = []*key{}
+		change_uncounted_keys = []*key{}
+		change_tick_start = change_tick
+		change_repeatable = true
+	}
+	change_keys = append(change_keys, kk)
+	change_uncounted_keys = append(change_uncounted_keys, kk)
+}
+
+// The last key recorded was part of a count
+func change_record_count() {
+	if change_replaying || len(change_uncounted_keys) == 0 {
+		return
+	}
+	change_uncounted_keys = change_uncounted_keys[:len(change_uncounted_keys)-1]
+}
+
+// Once back in normal mode with no keys pending the command is complete, keep
+// it if it changed something
+func change_record_end() {
+	if editor_mode == "prompt" {
+		change_repeatable = false
+	}
+	if change_replaying || change_keys == nil {
+		return
+	}
+	b := current_view_tree.leaf.buf
+	if editor_mode != "normal" || len(keys_entered.keys) > 0 || keys_count > 0 ||
+		b.is_in_mode("visual") || b.is_in_mode("visual-line") {
+		return
+	}
+	if change_repeatable && change_tick != change_tick_start {
+		last_change_keys = change_keys
+		last_change_uncounted_keys = change_uncounted_keys
+	}
+	change_keys = nil
+	change_uncounted_keys = nil
+}
+
+func command_repeat_change(vt *view_tree, b *buffer, kl *key_list) {
+	// The . itself isn't a change to record
+	change_keys = nil
+	if last_change_keys == nil {
+		message("No change to repeat")
+		return
+	}
+
+	keys := last_change_keys
+	if kl.count > 0 {
+		// A new count replaces every count the change was made with (2 d 3 w
+		// then 4 . deletes 4 words)
+		keys = []*key{}
+		for _, d := range strconv.Itoa(kl.count) {
+			keys = append(keys, &key{key: tcell.KeyRune, chr: d})
+		}
+		keys = append(keys, last_change_uncounted_keys...)
+	}
+
+	change_replaying = true
+	defer func() { change_replaying = false }()
+	feed_keys(keys)
+}
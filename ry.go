@@ -27,6 +27,7 @@ const (
 
 var (
 	keys_entered                     = new_key_list("")
+	keys_count                       = 0
 	last_key                         = new_key_list("")
 	term_events                      = make(chan tcell.Event, 500)
 	default_clipboard                = '_'
@@ -51,13 +52,28 @@ func main() {
 	defer handle_panics()
 
 	init_modes()
+	init_operators()
 	init_commands()
+	init_undo()
+	init_repeat()
+	init_macros()
+	init_registers()
+	init_windows()
+	init_tabs()
+	init_wrap()
+	init_messages()
+	init_choice()
+	init_completion()
+	init_ranges()
+	init_substitute()
 
 	init_config()
 	init_hooks()
+	init_status_line()
 	init_highlighting()
 	init_search()
 	init_visual()
+	init_text_objects()
 
 	init_screen()
 	init_term_events()
@@ -73,6 +89,9 @@ top:
 			switch ev := ev.(type) {
 			case *tcell.EventKey:
 				if ev.Key() == tcell.KeyCtrlQ {
+					for _, b := range buffers {
+						undo_file_write(b)
+					}
 					screen.Fini()
 					break top
 					/*
@@ -83,21 +102,7 @@ top:
 							keys_entered = k("")
 					*/
 				} else {
-					keys_entered.add_key(new_key_from_event(ev))
-
-					buf := current_view_tree.leaf.buf
-					for _, mode_name := range buf.modes {
-						if matched := mode_handle(must_find_mode(mode_name), keys_entered); matched != nil {
-							keys_entered = k("")
-							last_key = matched
-							continue top
-						}
-					}
-					if matched := mode_handle(must_find_mode(editor_mode), keys_entered); matched != nil {
-						keys_entered = k("")
-						last_key = matched
-						continue top
-					}
+					handle_key(new_key_from_event(ev))
 				}
 			case *tcell.EventResize:
 				editor_width, editor_height = screen.Size()
@@ -125,24 +130,95 @@ type mode struct {
 
 var modes = map[string]*mode{}
 
-func mode_handle(m *mode, kl *key_list) *key_list {
+// Modes in which typing digits before a command gives it a count
+var count_modes = []string{"normal", "operator-pending"}
+
+func handle_key(kk *key) {
+	macro_record_key(kk)
+	change_record_key(kk)
+	defer change_record_end()
+	// The command may have moved to another window
+	defer func() { current_view_tree.leaf.activate() }()
+	current_view_tree.leaf.activate()
+
+	if list_contains_string(count_modes, editor_mode) &&
+		len(keys_entered.keys) == 0 && kk.is_rune() && is_num(kk.chr) &&
+		(kk.chr != '0' || keys_count > 0) {
+		keys_count = keys_count*10 + int(kk.chr-'0')
+		change_record_count()
+		return
+	}
+
+	keys_entered.add_key(kk)
+
+	buf := current_view_tree.leaf.buf
+	for _, mode_name := range buf.modes {
+		if matched := mode_handle(must_find_mode(mode_name), keys_entered, keys_count); matched != nil {
+			keys_entered = k("")
+			keys_count = 0
+			last_key = matched
+			return
+		}
+	}
+	// Wait for the rest of a buffer mode's binding before falling back on
+	// the editor mode's (i w in visual mode instead of i)
+	for _, mode_name := range buf.modes {
+		if mode_has_prefix(must_find_mode(mode_name), keys_entered) {
+			return
+		}
+	}
+	if matched := mode_handle(must_find_mode(editor_mode), keys_entered, keys_count); matched != nil {
+		keys_entered = k("")
+		keys_count = 0
+		last_key = matched
+	}
+}
+
+// Runs keys through handle_key as if they were typed, dropping any pending
+// keys first
+func feed_keys(keys []*key) {
+	keys_entered = k("")
+	keys_count = 0
+	for _, kk := range keys {
+		handle_key(kk)
+	}
+}
+
+func mode_handle(m *mode, kl *key_list, count int) *key_list {
 	var match *key_list = nil
 	var match_binding *mode_binding = nil
 	for _, binding := range m.bindings {
 		if matched := kl.has_suffix(binding.k); matched != nil {
-			if match == nil || len(matched.keys) > len(match.keys) {
+			// Longest match wins, then the one with the fewest $any like
+			// keys (so that TAB can be bound next to $any)
+			if match == nil || len(matched.keys) > len(match.keys) ||
+				len(matched.keys) == len(match.keys) && binding.k.wildcards() < match_binding.k.wildcards() {
 				match_binding = binding
 				match = matched
 			}
 		}
 	}
 	if match != nil {
+		match.count = count
 		match_binding.f(current_view_tree, current_view_tree.leaf.buf, match)
 		return match
 	}
 	return nil
 }
 
+// Whether the end of kl is the beginning of one of m's bindings
+func mode_has_prefix(m *mode, kl *key_list) bool {
+	for _, binding := range m.bindings {
+		for i := len(kl.keys) - 1; i >= 0 && len(kl.keys)-i < len(binding.k.keys); i-- {
+			tail := &key_list{keys: kl.keys[i:]}
+			if tail.matches(&key_list{keys: binding.k.keys[:len(tail.keys)]}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func find_mode(name string) *mode {
 	if m, ok := modes[name]; ok {
 		return m
@@ -181,23 +257,24 @@ func bind(mode_name string, k *key_list, f command_fn) {
 
 func init_modes() {
 	add_mode("normal")
+	add_mode("operator-pending")
 	bind("normal", k("m $alpha"), command_mark)
 	bind("normal", k("' $alpha"), command_move_to_mark)
 	bind("normal", k(":"), prompt_command)
-	bind("normal", k("h"), move_left)
-	bind("normal", k("j"), move_down)
-	bind("normal", k("k"), move_up)
-	bind("normal", k("l"), move_right)
-	bind("normal", k("0"), move_line_beg)
-	bind("normal", k("$"), move_line_end)
-	bind("normal", k("g g"), move_top)
-	bind("normal", k("G"), move_bottom)
-	bind("normal", k("C-u"), move_jump_up)
-	bind("normal", k("C-d"), move_jump_down)
+	bind_motion("h", motion_exclusive, move_left)
+	bind_motion("j", motion_linewise, move_down)
+	bind_motion("k", motion_linewise, move_up)
+	bind_motion("l", motion_exclusive, move_right)
+	bind_motion("0", motion_exclusive, move_line_beg)
+	bind_motion("$", motion_exclusive, move_line_end)
+	bind_motion("g g", motion_linewise, move_top)
+	bind_motion("G", motion_linewise, move_bottom)
+	bind_motion("C-u", motion_linewise, move_jump_up)
+	bind_motion("C-d", motion_linewise, move_jump_down)
 	bind("normal", k("z z"), move_center_line)
-	bind("normal", k("w"), move_word_forward)
-	bind("normal", k("e"), move_word_end_forward)
-	bind("normal", k("b"), move_word_backward)
+	bind_motion("w", motion_exclusive, move_word_forward)
+	bind_motion("e", motion_inclusive, move_word_end_forward)
+	bind_motion("b", motion_exclusive, move_word_backward)
 	bind("normal", k("C-c"), cancel_keys_entered)
 	bind("normal", k("C-g"), cancel_keys_entered)
 	bind("normal", k("ESC ESC"), cancel_keys_entered)
@@ -207,8 +284,6 @@ func init_modes() {
 	bind("normal", k("o"), enter_insert_mode_nl)
 	bind("normal", k("O"), enter_insert_mode_nl_up)
 	bind("normal", k("x"), remove_char)
-	bind("normal", k("d d"), remove_line)
-	bind("normal", k("y y"), command_copy_line)
 	bind("normal", k("p"), command_paste)
 	bind("normal", k("u"), command_undo)
 	bind("normal", k("C-r"), command_redo)
@@ -227,6 +302,20 @@ func init_modes() {
 	bind("prompt", k("ESC"), prompt_cancel)
 	bind("prompt", k("RET"), prompt_finish)
 	bind("prompt", k("BAK"), prompt_backspace)
+	bind("prompt", k("DEL"), prompt_delete)
+	bind("prompt", k("C-w"), prompt_delete_word)
+	bind("prompt", k("C-u"), prompt_clear)
+	bind("prompt", k("LEFT"), prompt_move(-1))
+	bind("prompt", k("RIGHT"), prompt_move(1))
+	bind("prompt", k("HOME"), prompt_move_home)
+	bind("prompt", k("C-b"), prompt_move_home)
+	bind("prompt", k("END"), prompt_move_end)
+	bind("prompt", k("C-e"), prompt_move_end)
+	bind("prompt", k("C-r"), func(vt *view_tree, b *buffer, kl *key_list) {
+		prompt_register_pending = true
+	})
+	bind("prompt", k("UP"), prompt_history_move(-1))
+	bind("prompt", k("DOWN"), prompt_history_move(1))
 	bind("prompt", k("$any"), prompt_insert)
 
 	add_mode("buffers")
@@ -234,8 +323,8 @@ func init_modes() {
 		close_current_buffer(true)
 	})
 	bind("buffers", k("RET"), func(vt *view_tree, b *buffer, kl *key_list) {
-		close_current_buffer(true)
-		show_buffer(string(b.data[b.cursor.line]))
+		show_buffer(string(b.get_line(b.cursor.line)))
+		close_buffer(b)
 	})
 
 	add_mode("directory")
@@ -243,9 +332,9 @@ func init_modes() {
 		close_current_buffer(true)
 	})
 	bind("directory", k("RET"), func(vt *view_tree, b *buffer, kl *key_list) {
-		close_current_buffer(true)
-		file_path := filepath.Join(b.path, string(b.data[b.cursor.line]))
+		file_path := filepath.Join(b.path, string(b.get_line(b.cursor.line)))
 		run_command([]string{"edit", file_path})
+		close_buffer(b)
 	})
 
 	// TODO Remove once I have user configurable bindings
@@ -265,54 +354,77 @@ func init_modes() {
 }
 
 func move_left(vt *view_tree, b *buffer, kl *key_list) {
-	b.move(-1, 0)
+	b.move(-kl.times(), 0)
 }
 func move_right(vt *view_tree, b *buffer, kl *key_list) {
-	b.move(1, 0)
+	b.move(kl.times(), 0)
 }
 func move_up(vt *view_tree, b *buffer, kl *key_list) {
-	b.move(0, -1)
+	b.move(0, -kl.times())
 }
 func move_down(vt *view_tree, b *buffer, kl *key_list) {
-	b.move(0, 1)
+	b.move(0, kl.times())
 }
 func move_line_beg(vt *view_tree, b *buffer, kl *key_list) {
 	b.move_to(0, b.cursor.line)
 }
 func move_line_end(vt *view_tree, b *buffer, kl *key_list) {
-	b.move_to(len(b.data[b.cursor.line]), b.cursor.line)
+	l := min(b.cursor.line+kl.times()-1, b.line_count()-1)
+	b.move_to(len(b.get_line(l)), l)
 }
 func move_top(vt *view_tree, b *buffer, kl *key_list) {
-	b.move_to(0, 0)
+	b.move_to(0, max(kl.count-1, 0))
 }
 func move_bottom(vt *view_tree, b *buffer, kl *key_list) {
-	b.move_to(0, len(b.data)-1)
+	if kl.count > 0 {
+		b.move_to(0, kl.count-1)
+	} else {
+		b.move_to(0, b.line_count()-1)
+	}
 }
 func move_jump_up(vt *view_tree, b *buffer, kl *key_list) {
-	b.move(0, -15)
+	b.move(0, -15*kl.times())
 }
 func move_jump_down(vt *view_tree, b *buffer, kl *key_list) {
-	b.move(0, 15)
+	b.move(0, 15*kl.times())
 }
 func move_center_line(vt *view_tree, b *buffer, kl *key_list) {
 	vt.leaf.center_pending = true
 }
 func move_word_backward(vt *view_tree, b *buffer, kl *key_list) {
-	b.move_word_backward()
+	for i := 0; i < kl.times() && b.move_word_backward(); i++ {
+	}
 }
 func move_word_forward(vt *view_tree, b *buffer, kl *key_list) {
-	b.move_word_forward()
+	for i := 0; i < kl.times() && b.move_word_forward(); i++ {
+	}
 }
 func move_word_end_forward(vt *view_tree, b *buffer, kl *key_list) {
-	b.move_word_end_forward()
+	for i := 0; i < kl.times() && b.move_word_end_forward(); i++ {
+	}
 }
 
 func cancel_keys_entered(vt *view_tree, b *buffer, kl *key_list) {
 	keys_entered = k("")
+	keys_count = 0
+	register_pending = 0
 }
 
+// Buffer the insert session's change group was opened on
+var insert_group_buffer *buffer = nil
+
 // Enter in a new mode
 func enter_mode(mode string) {
+	// A whole insert session is undone at once
+	if editor_mode == "insert" && mode != "insert" && insert_group_buffer != nil {
+		insert_group_buffer.end_change_group()
+		insert_group_buffer = nil
+	}
+	if mode == "insert" && editor_mode != "insert" && current_view_tree != nil {
+		last_inserted_text = []rune{}
+		insert_group_buffer = current_view_tree.leaf.buf
+		insert_group_buffer.begin_change_group()
+	}
 	editor_mode = mode
 	// TODO maybe not the best place to clear this
 	message("")
@@ -334,12 +446,16 @@ func enter_insert_mode_eol(vt *view_tree, b *buffer, kl *key_list) {
 	enter_mode("insert")
 }
 func enter_insert_mode_nl(vt *view_tree, b *buffer, kl *key_list) {
+	b.begin_change_group()
+	defer b.end_change_group()
 	move_line_end(vt, b, kl)
 	b.insert([]rune("\n"))
 	b.move(0, 1) // ensure a valid position
 	enter_mode("insert")
 }
 func enter_insert_mode_nl_up(vt *view_tree, b *buffer, kl *key_list) {
+	b.begin_change_group()
+	defer b.end_change_group()
 	move_line_beg(vt, b, kl)
 	b.insert([]rune("\n"))
 	b.move(0, 0) // ensure a valid position
@@ -347,23 +463,33 @@ func enter_insert_mode_nl_up(vt *view_tree, b *buffer, kl *key_list) {
 }
 
 func insert_enter(vt *view_tree, b *buffer, kl *key_list) {
+	line := b.get_line(b.cursor.line)
 	i := 0
-	for ; i < len(b.data[b.cursor.line]) && is_space(b.data[b.cursor.line][i]); i++ {
+	for ; i < len(line) && is_space(line[i]); i++ {
 	}
 	b.insert([]rune("\n" + strings.Repeat(" ", i)))
+	last_inserted_text = append(last_inserted_text, '\n')
 	b.move_to(i, b.cursor.line+1)
 }
+
+// Forgets the last n runes typed, as they were removed
+func trim_last_inserted_text(n int) {
+	last_inserted_text = last_inserted_text[:max(len(last_inserted_text)-n, 0)]
+}
+
 func insert_backspace(vt *view_tree, b *buffer, kl *key_list) {
 	if b.cursor.char == 0 {
 		if b.cursor.line != 0 {
 			move_up(vt, b, kl)
 			move_line_end(vt, b, kl)
 			b.remove(1)
+			trim_last_inserted_text(1)
 		}
 	} else {
 		if b.char_at_left() != ' ' {
 			b.move(-1, 0)
 			b.remove(1)
+			trim_last_inserted_text(1)
 			return
 		}
 		// handle spaces
@@ -374,6 +500,7 @@ func insert_backspace(vt *view_tree, b *buffer, kl *key_list) {
 		for i := 0; i < delete_n && b.char_at_left() == ' '; i++ {
 			b.move(-1, 0)
 			b.remove(1)
+			trim_last_inserted_text(1)
 		}
 	}
 }
@@ -381,16 +508,18 @@ func insert(vt *view_tree, b *buffer, kl *key_list) {
 	k := kl.keys[len(kl.keys)-1]
 	if k.key == tcell.KeyTab {
 		if config_get_bool("tab_to_spaces", b) {
-			tab_width := int(config_get_number("tab_width", b))
-			message(strconv.Itoa(tab_width))
-			b.insert([]rune(strings.Repeat(" ", tab_width)))
-			b.move(tab_width, 0)
+			spaces := []rune(strings.Repeat(" ", int(config_get_number("tab_width", b))))
+			b.insert(spaces)
+			last_inserted_text = append(last_inserted_text, spaces...)
+			b.move(len(spaces), 0)
 		} else {
 			b.insert([]rune{'\t'})
+			last_inserted_text = append(last_inserted_text, '\t')
 			b.move(1, 0)
 		}
 	} else if k.key == tcell.KeyRune && k.mod == 0 {
 		b.insert([]rune{k.chr})
+		last_inserted_text = append(last_inserted_text, k.chr)
 		move_right(vt, b, kl)
 	} else {
 		message("Can't insert '" + kl.String() + "'")
@@ -398,35 +527,43 @@ func insert(vt *view_tree, b *buffer, kl *key_list) {
 }
 
 func remove_char(vt *view_tree, b *buffer, kl *key_list) {
-	removed := b.remove(1)
-	clipboard_set(default_clipboard, removed)
-}
-func remove_line(vt *view_tree, b *buffer, kl *key_list) {
-	move_line_beg(vt, b, kl)
-	removed := b.remove(len(b.data[b.cursor.line]) + 1)
-	clipboard_set(default_clipboard, removed)
+	n := min(kl.times(), len(b.get_line(b.cursor.line))-b.cursor.char)
+	if n <= 0 {
+		return
+	}
+	removed := b.remove(n)
+	register_delete(removed)
 }
 
 func command_undo(vt *view_tree, b *buffer, kl *key_list) {
-	b.undo()
+	for i := 0; i < kl.times(); i++ {
+		b.undo()
+	}
 }
 func command_redo(vt *view_tree, b *buffer, kl *key_list) {
-	b.redo()
-}
-func command_copy_line(vt *view_tree, b *buffer, kl *key_list) {
-	value := make([]rune, len(b.data[b.cursor.line])+1)
-	copy(value, b.data[b.cursor.line])
-	value[len(value)-1] = '\n'
-	clipboard_set(default_clipboard, value)
+	for i := 0; i < kl.times(); i++ {
+		b.redo()
+	}
 }
 func command_paste(vt *view_tree, b *buffer, kl *key_list) {
-	value := clipboard_get(default_clipboard)
+	value := clipboard_get(register_take())
 	if len(value) == 0 {
 		message("Nothing to paste!")
 		return
 	}
+	repeated := []rune{}
+	for i := 0; i < kl.times(); i++ {
+		repeated = append(repeated, value...)
+	}
+	if value[len(value)-1] == '\n' {
+		// Whole lines are pasted under the current one
+		b.move_to(len(b.get_line(b.cursor.line)), b.cursor.line)
+		b.insert(append([]rune{'\n'}, repeated[:len(repeated)-1]...))
+		b.move_to(0, b.cursor.line+1)
+		return
+	}
 	b.move(1, 0)
-	b.insert(value)
+	b.insert(repeated)
 }
 
 func command_mark(vt *view_tree, b *buffer, kl *key_list) {
@@ -445,15 +582,21 @@ var (
 	editor_is_prompt_active                           = false
 	editor_prompt                                     = ""
 	editor_prompt_value                               = ""
-	editor_prompt_callback_fn   func([]string)        = nil
+	editor_prompt_cursor                              = 0
+	prompt_register_pending                           = false
+	editor_prompt_callback_fn   func(string)          = nil
 	editor_prompt_completion_fn func(string) []string = nil
 )
 
-func prompt(prompt string, comp_fn func(string) []string, cb_fn func([]string)) {
+func prompt(prompt string, comp_fn func(string) []string, cb_fn func(string)) {
 	editor_prompt = prompt
 	editor_prompt_value = ""
+	editor_prompt_cursor = 0
+	prompt_register_pending = false
 	editor_prompt_callback_fn = cb_fn
 	editor_prompt_completion_fn = comp_fn
+	completion_clear()
+	prompt_history_start(prompt)
 	enter_mode("prompt")
 }
 
@@ -461,8 +604,9 @@ func noop_complete(prefix string) []string {
 	return []string{}
 }
 
+// Editing the line hides the completion menu until the next TAB
 func prompt_update_completion() {
-	// TODO
+	completion_clear()
 }
 
 func prompt_cancel(vt *view_tree, b *buffer, kl *key_list) {
@@ -471,36 +615,100 @@ func prompt_cancel(vt *view_tree, b *buffer, kl *key_list) {
 
 func prompt_finish(vt *view_tree, b *buffer, kl *key_list) {
 	enter_mode("normal")
-	// TODO better args parsing
-	editor_prompt_callback_fn(strings.Split(editor_prompt_value, " "))
+	prompt_history_add(editor_prompt, editor_prompt_value)
+	editor_prompt_callback_fn(editor_prompt_value)
+}
+
+// Replaces the whole value, leaving the cursor at it's end
+func prompt_set_value(value string) {
+	editor_prompt_value = value
+	editor_prompt_cursor = utf8.RuneCountInString(value)
+}
+
+// Replaces the chars between from and to (rune indexes) by text, leaving the
+// cursor after it
+func prompt_replace(from, to int, text string) {
+	value := []rune(editor_prompt_value)
+	editor_prompt_value = string(value[:from]) + text + string(value[to:])
+	editor_prompt_cursor = from + utf8.RuneCountInString(text)
+	prompt_update_completion()
 }
 
 func prompt_backspace(vt *view_tree, b *buffer, kl *key_list) {
-	if len(editor_prompt_value) > 0 {
-		editor_prompt_value = editor_prompt_value[:len(editor_prompt_value)-1]
-		prompt_update_completion()
+	if editor_prompt_cursor > 0 {
+		prompt_replace(editor_prompt_cursor-1, editor_prompt_cursor, "")
 	}
 }
 
+func prompt_delete(vt *view_tree, b *buffer, kl *key_list) {
+	if editor_prompt_cursor < utf8.RuneCountInString(editor_prompt_value) {
+		prompt_replace(editor_prompt_cursor, editor_prompt_cursor+1, "")
+	}
+}
+
+// Deletes the word (and the spaces following it) before the cursor
+func prompt_delete_word(vt *view_tree, b *buffer, kl *key_list) {
+	value := []rune(editor_prompt_value)
+	i := editor_prompt_cursor
+	for i > 0 && is_space(value[i-1]) {
+		i--
+	}
+	for i > 0 && !is_space(value[i-1]) {
+		i--
+	}
+	prompt_replace(i, editor_prompt_cursor, "")
+}
+
+func prompt_clear(vt *view_tree, b *buffer, kl *key_list) {
+	prompt_replace(0, editor_prompt_cursor, "")
+}
+
+func prompt_move(n int) command_fn {
+	return func(vt *view_tree, b *buffer, kl *key_list) {
+		editor_prompt_cursor = max(min(editor_prompt_cursor+n, utf8.RuneCountInString(editor_prompt_value)), 0)
+	}
+}
+
+func prompt_move_home(vt *view_tree, b *buffer, kl *key_list) {
+	editor_prompt_cursor = 0
+}
+
+func prompt_move_end(vt *view_tree, b *buffer, kl *key_list) {
+	editor_prompt_cursor = utf8.RuneCountInString(editor_prompt_value)
+}
+
 func prompt_insert(vt *view_tree, b *buffer, kl *key_list) {
 	k := kl.keys[len(kl.keys)-1]
+	// After C-r, inserts the contents of a register without it's final new
+	// line
+	if prompt_register_pending {
+		prompt_register_pending = false
+		if k.is_rune() && is_register(k.chr) {
+			text := strings.TrimSuffix(string(clipboard_get(k.chr)), "\n")
+			prompt_replace(editor_prompt_cursor, editor_prompt_cursor, text)
+		}
+		return
+	}
 	if k.key == tcell.KeyRune && k.mod == 0 {
-		editor_prompt_value += string(k.chr)
-		prompt_update_completion()
+		prompt_replace(editor_prompt_cursor, editor_prompt_cursor, string(k.chr))
 	}
 }
 
 func prompt_command(vt *view_tree, b *buffer, kl *key_list) {
-	prompt(":", func(prefix string) []string {
-		// TODO provide command suggestions
-		return []string{}
-	}, run_command)
+	prompt(":", complete_command, func(line string) {
+		last_command = line
+		run_command_line(line)
+	})
 }
 
 // }}}
 
 // {{{ clipboard
 func clipboard_get(register rune) []rune {
+	if is_read_only_register(register) {
+		return register_read_only_value(register)
+	}
+	register = unicode.ToLower(register)
 	if register == default_clipboard {
 		if value, err := zclip.ReadAll("clipboard"); err == nil {
 			return []rune(value)
@@ -513,6 +721,10 @@ func clipboard_get(register rune) []rune {
 }
 
 func clipboard_set(register rune, value []rune) {
+	if unicode.IsUpper(register) {
+		register = unicode.ToLower(register)
+		value = append(append([]rune{}, clipboard_get(register)...), value...)
+	}
 	if register == default_clipboard {
 		if err := zclip.WriteAll(string(value), "clipboard"); err != nil {
 			message_error("Error clipboard_get: " + err.Error())
@@ -607,26 +819,22 @@ func new_char_range(b, e int) *char_range {
 }
 
 type buffer struct {
-	data               [][]rune
-	history            []*action
-	history_index      int
-	name               string
-	path               string
-	modified           bool
-	cursor             *location
-	modes              []string
-	last_render_width  int
-	last_render_height int
+	text     *text_store
+	history  *undo_tree
+	name     string
+	path     string
+	modified bool
+	cursor   *location
+	modes    []string
 }
 
 func new_buffer(name string, path string) *buffer {
 	b := &buffer{
-		data:          [][]rune{{}},
-		history:       []*action{},
-		history_index: -1,
-		modified:      false,
-		cursor:        new_location(0, 0),
-		modes:         []string{},
+		text:     new_text_store([]rune{}),
+		history:  new_undo_tree(),
+		modified: false,
+		cursor:   new_location(0, 0),
+		modes:    []string{},
 	}
 
 	if path == "" {
@@ -651,7 +859,7 @@ func (b *buffer) is_in_mode(name string) bool {
 }
 
 func (b *buffer) char_at(l, c int) rune {
-	line := b.data[l]
+	line := b.get_line(l)
 	if c < 0 {
 		return rune(0)
 	} else if c < len(line) {
@@ -661,8 +869,23 @@ func (b *buffer) char_at(l, c int) rune {
 	}
 }
 
+// The returned line is shared with the buffer and must not be modified
 func (b *buffer) get_line(l int) []rune {
-	return b.data[l]
+	return b.text.line(l)
+}
+
+func (b *buffer) line_count() int {
+	return b.text.line_count()
+}
+
+// Rune offset of loc from the start of the buffer
+func (b *buffer) offset(loc *location) int {
+	return b.text.offset(loc.line, loc.char)
+}
+
+// Range covering lines l1 to l2 including the newline ending l2
+func (b *buffer) line_range(l1, l2 int) *char_range {
+	return new_char_range(b.text.line_start(l1), b.text.line_start(l2+1))
 }
 
 func (b *buffer) char_at_left() rune {
@@ -695,12 +918,12 @@ func (b *buffer) first_line() bool {
 }
 
 func (b *buffer) last_line() bool {
-	return b.cursor.line == len(b.data)-1
+	return b.cursor.line == b.line_count()-1
 }
 
 func (b *buffer) move_to(c, l int) {
-	b.cursor.line = max(min(l, len(b.data)-1), 0)
-	b.cursor.char = max(min(c, len(b.data[b.cursor.line])), 0)
+	b.cursor.line = max(min(l, b.line_count()-1), 0)
+	b.cursor.char = max(min(c, len(b.get_line(b.cursor.line))), 0)
 	hook_trigger_buffer("moved", b)
 }
 
@@ -782,7 +1005,7 @@ func (b *buffer) move_word_backward() bool {
 			if b.first_line() {
 				return false
 			} else {
-				b.move_to(len(b.data[b.cursor.line-1]), b.cursor.line-1)
+				b.move_to(len(b.get_line(b.cursor.line-1)), b.cursor.line-1)
 				continue
 			}
 		}
@@ -809,40 +1032,44 @@ func (b *buffer) move_word_backward() bool {
 }
 
 func (b *buffer) insert(data []rune) {
+	change_tick++
 	a := new_action(action_type_insert, b.cursor.clone(), data)
-	b.history_index++
-	b.history = try_merge_history(b.history[:b.history_index], a)
 	a.apply(b)
+	b.history.add(b, a)
 }
 
 func (b *buffer) remove_at(loc *location, n int) []rune {
+	change_tick++
 	a := new_action(action_type_remove, loc.clone(), make([]rune, n))
-	b.history_index++
-	b.history = try_merge_history(b.history[:b.history_index], a)
 	a.apply(b)
-	return a.data
+	removed := a.data
+	b.history.add(b, a)
+	return removed
 }
 
 func (b *buffer) remove(n int) []rune {
 	return b.remove_at(b.cursor, n)
 }
 
-func (b *buffer) undo() {
-	if b.history_index >= 0 && b.history_index != -1 {
-		b.history[b.history_index].revert(b)
-		b.history_index--
-	} else {
-		message("Noting to undo!")
-	}
-}
-
-func (b *buffer) redo() {
-	if b.history_index+1 < len(b.history) && len(b.history) > b.history_index+1 {
-		b.history_index++
-		b.history[b.history_index].apply(b)
+// Merges action a into prev when a continues it (typing, repeated x or
+// backspace), returns whether it was merged
+func try_merge_history(prev, a *action) bool {
+	if prev.typ == action_type_insert && a.typ == action_type_insert && a.loc.equal(prev.end) {
+		prev.data = append(prev.data, a.data...)
+	} else if prev.typ == action_type_remove && a.typ == action_type_remove && a.loc.equal(prev.loc) {
+		prev.data = append(prev.data, a.data...)
+	} else if prev.typ == action_type_remove && a.typ == action_type_remove && a.end.equal(prev.loc) {
+		prev.data = append(append([]rune{}, a.data...), prev.data...)
+		prev.loc = a.loc
+	} else if prev.typ == action_type_insert && a.typ == action_type_remove && a.end.equal(prev.end) &&
+		len(a.data) <= len(prev.data) && string(prev.data[len(prev.data)-len(a.data):]) == string(a.data) {
+		// Backspacing over just typed text
+		prev.data = prev.data[:len(prev.data)-len(a.data)]
 	} else {
-		message("Noting to redo!")
+		return false
 	}
+	prev.end = location_after(prev.loc, prev.data)
+	return true
 }
 
 func (b *buffer) set_path(path string) {
@@ -851,21 +1078,18 @@ func (b *buffer) set_path(path string) {
 	if err != nil {
 		b.path = filepath.Clean(path)
 	}
-	b.name = ""
 	name := filepath.Base(b.path)
+	b.name = name
 
 	i := 1
 check_name:
 	for _, b2 := range buffers {
-		if b2.name == name {
+		if b2 != b && b2.name == b.name {
 			b.name = name + " " + strconv.Itoa(i)
 			i++
 			goto check_name
 		}
 	}
-	if b.name == "" {
-		b.name = name
-	}
 }
 
 func (b *buffer) add_mode(name string) {
@@ -884,12 +1108,13 @@ func (b *buffer) remove_mode(name string) {
 	}
 }
 
+// Replaces the whole text of the buffer, bypassing history
+func (b *buffer) set_contents(contents string) {
+	b.text = new_text_store([]rune(contents))
+}
+
 func (b *buffer) contents() string {
-	ret := ""
-	for _, line := range b.data {
-		ret += string(line) + "\n"
-	}
-	return ret
+	return b.text.String() + "\n"
 }
 
 func (b *buffer) nice_path() string {
@@ -901,18 +1126,29 @@ func (b *buffer) save() {
 		message_error("Can't save a buffer without a path.")
 		return
 	}
-	err := ioutil.WriteFile(b.path, []byte(b.contents()), 0666)
+	err := b.write_file()
 	if err != nil {
 		message_error("Error saving buffer: " + err.Error())
 	} else {
 		b.modified = false
+		undo_file_write(b)
+		hook_trigger_buffer("saved", b)
 		message("Buffer written to '" + b.nice_path() + "'")
 	}
 }
 
-func try_merge_history(al []*action, a *action) []*action {
-	// TODO save end location on actions so that we can merge them here
-	return append(al, a)
+func (b *buffer) write_file() error {
+	file, err := os.OpenFile(b.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if err = b.text.write_to(file); err == nil {
+		_, err = file.WriteString("\n")
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	return err
 }
 
 // }}}
@@ -926,8 +1162,11 @@ const (
 )
 
 type action struct {
-	typ  action_type
-	loc  *location
+	typ action_type
+	loc *location
+	// Location right after data when it is in the buffer, after an insert
+	// and before a remove
+	end  *location
 	data []rune
 }
 
@@ -956,39 +1195,60 @@ func (a *action) do(b *buffer, typ action_type) {
 }
 
 func (a *action) insert(b *buffer) {
-	c, l := a.loc.char, a.loc.line
-	for i := len(a.data) - 1; i >= 0; i-- {
-		ch := a.data[i]
-		if ch == '\n' {
-			rest := append([]rune(nil), b.data[l][c:]...)
-			b.data[l] = b.data[l][:c]
-			b.data = append(b.data[:l+1],
-				append([][]rune{rest}, b.data[l+1:]...)...)
-		} else {
-			b.data[l] = append(b.data[l][:c],
-				append([]rune{ch}, b.data[l][c:]...)...)
+	offset := b.text.offset(a.loc.line, a.loc.char)
+	b.keep_view_cursors(offset, len(a.data), func() {
+		b.text.insert(offset, a.data)
+	})
+	a.end = location_after(a.loc, a.data)
+	sign_shift(b, a.loc, a.end, false)
+}
+
+func (a *action) remove(b *buffer) {
+	offset := b.text.offset(a.loc.line, a.loc.char)
+	b.keep_view_cursors(offset, -len(a.data), func() {
+		a.data = b.text.remove(offset, len(a.data))
+	})
+	a.end = location_after(a.loc, a.data)
+	sign_shift(b, a.loc, a.end, true)
+}
+
+// Keeps the cursors of the buffer's inactive views on the same text across
+// an edit at offset inserting n runes (removing -n runes when negative)
+func (b *buffer) keep_view_cursors(offset, n int, edit func()) {
+	cursors := []*location{}
+	offsets := []int{}
+	for _, v := range all_views() {
+		if v.buf == b && v.cursor != b.cursor {
+			cursors = append(cursors, v.cursor)
+			offsets = append(offsets, b.text.offset(v.cursor.line, v.cursor.char))
+		}
+	}
+	edit()
+	for i, c := range cursors {
+		o := offsets[i]
+		if n > 0 && o >= offset {
+			o += n
+		} else if n < 0 && o >= offset-n {
+			o += n
+		} else if n < 0 && o > offset {
+			o = offset
 		}
+		c.line, c.char = b.text.location(o)
 	}
 }
 
-func (a *action) remove(b *buffer) {
-	n := len(a.data)
-	c, l := a.loc.char, a.loc.line
-	removed := []rune{}
-	for i := 0; i < n; i++ {
-		removed = append(removed, b.char_at(l, c))
-		if b.char_at(l, c) == '\n' {
-			if len(b.data)-1 == l {
-				a.data = removed
-				return
-			}
-			b.data[l] = append(b.data[l], b.data[l+1]...)
-			b.data = append(b.data[:l+1], b.data[l+2:]...)
+// Location the cursor would be at after typing data at loc
+func location_after(loc *location, data []rune) *location {
+	end := loc.clone()
+	for _, ch := range data {
+		if ch == '\n' {
+			end.line++
+			end.char = 0
 		} else {
-			b.data[l] = append(b.data[l][:c], b.data[l][c+1:]...)
+			end.char++
 		}
 	}
-	a.data = removed
+	return end
 }
 
 // }}}
@@ -1010,7 +1270,6 @@ func open_buffer_from_file(path string) *buffer {
 				return nil
 			}
 			buf := new_buffer(filepath.Base(path), path)
-			buf.data = [][]rune{}
 			file_names := []string{}
 			for _, file_info := range files {
 				if file_info.IsDir() {
@@ -1021,13 +1280,12 @@ func open_buffer_from_file(path string) *buffer {
 			}
 			file_names = append(file_names, " ..")
 			sort.Strings(file_names)
-			for _, file_name := range file_names {
+			for i, file_name := range file_names {
 				if file_name[0] == ' ' { // is dir
-					buf.data = append(buf.data, []rune(file_name[1:]+"/"))
-				} else {
-					buf.data = append(buf.data, []rune(file_name))
+					file_names[i] = file_name[1:] + "/"
 				}
 			}
+			buf.set_contents(strings.Join(file_names, "\n"))
 			buf.add_mode("directory")
 			buffers = append(buffers, buf)
 			hook_trigger_buffer("modified", buf)
@@ -1035,6 +1293,15 @@ func open_buffer_from_file(path string) *buffer {
 		}
 	}
 
+	// Files already open aren't read again
+	if abs_path, err := filepath.Abs(path); err == nil {
+		for _, b := range buffers {
+			if b.path == abs_path && !b.is_in_mode("directory") {
+				return b
+			}
+		}
+	}
+
 	buf := new_buffer(filepath.Base(path), path)
 	if buf.path != "" {
 		contents, err := ioutil.ReadFile(buf.path)
@@ -1042,13 +1309,9 @@ func open_buffer_from_file(path string) *buffer {
 			message_error("Error reading file '" + buf.nice_path() + "'")
 			return nil
 		}
-		buf.data = [][]rune{}
-		for _, line := range strings.Split(string(contents), "\n") {
-			buf.data = append(buf.data, []rune(line))
-		}
-		if len(buf.data) > 1 {
-			buf.data = buf.data[:len(buf.data)-1]
-		}
+		buf.set_contents(strings.TrimSuffix(string(contents), "\n"))
+		undo_file_read(buf)
+		hook_trigger_buffer("loaded", buf)
 	}
 	buffers = append(buffers, buf)
 	hook_trigger_buffer("modified", buf)
@@ -1062,19 +1325,27 @@ func open_buffer_named(name string) *buffer {
 	return buf
 }
 
-// TODO check if is shown first, then if not create split not replace
+// Shows a buffer in the current window, or moves to a window already showing
+// it when switch_to_open_window is set
 func show_buffer(buffer_name string) *buffer {
-	for _, b := range buffers {
-		if b.name == buffer_name {
-			if current_view_tree.leaf.buf == b {
-				return b // already shown
+	b := find_buffer(buffer_name)
+	if b == nil {
+		return nil
+	}
+	if current_view_tree.leaf.buf == b {
+		return b // already shown
+	}
+	if config_get_bool("switch_to_open_window", b) {
+		for _, vt := range root_view_tree.leaves() {
+			if vt.leaf.buf == b {
+				current_view_tree = vt
+				vt.leaf.activate()
+				return b
 			}
-			current_view_tree = new_view_tree_leaf(nil, new_view(b))
-			root_view_tree = current_view_tree
-			return b
 		}
 	}
-	return nil
+	current_view_tree.show(b)
+	return b
 }
 
 func close_current_buffer(force bool) {
@@ -1083,6 +1354,15 @@ func close_current_buffer(force bool) {
 		message_error("Save buffer before closing it.")
 		return
 	}
+	close_buffer(b)
+}
+
+// Windows showing a closed buffer are closed, the last window left shows
+// another buffer
+func close_buffer(b *buffer) {
+	undo_file_write(b)
+	delete(signs, b)
+	delete(buffer_formats, b)
 	for i, b2 := range buffers {
 		if b == b2 {
 			buffers = append(buffers[:i], buffers[i+1:]...)
@@ -1093,11 +1373,21 @@ func close_current_buffer(force bool) {
 		// TODO Use method here (don't handcode screen.Fini())
 		screen.Fini()
 		os.Exit(0)
-	} else {
-		// TODO call method to open left over buffer (don't set root too)
-		current_view_tree = new_view_tree_leaf(nil, new_view(buffers[0]))
-		root_view_tree = current_view_tree
 	}
+	tab_each(func() {
+		for _, vt := range root_view_tree.leaves() {
+			if vt.leaf.buf != b {
+				continue
+			}
+			if root_view_tree.leaf == nil {
+				window_close(vt)
+			} else if alt := vt.alternate_buffer(); alt != nil {
+				vt.show(alt)
+			} else {
+				vt.show(buffers[0])
+			}
+		}
+	})
 }
 
 func find_buffer(name string) *buffer {
@@ -1109,10 +1399,19 @@ func find_buffer(name string) *buffer {
 	return nil
 }
 
-var commands = map[string]func([]string){}
+// Commands get the range of lines typed before their name, nil when there
+// was none
+type ex_command_fn func(r *ex_range, args []string)
+
+var commands = map[string]ex_command_fn{}
 var command_aliases = map[string]string{}
 
 func run_command(args []string) {
+	run_command_range(nil, args)
+}
+
+// Runs a command over a range of lines, nil when none was given
+func run_command_range(r *ex_range, args []string) {
 	if len(args) == 0 {
 		message_error("No command given!")
 		return
@@ -1122,13 +1421,13 @@ func run_command(args []string) {
 		command_name = full_command_name
 	}
 	if c, ok := commands[command_name]; ok {
-		c(args)
+		c(r, args)
 	} else {
 		message_error("No command named '" + command_name + "'")
 	}
 }
 
-func add_command(name string, fn func([]string)) {
+func add_command(name string, fn ex_command_fn) {
 	commands[name] = fn
 }
 func add_alias(alias, name string) {
@@ -1136,23 +1435,67 @@ func add_alias(alias, name string) {
 }
 
 func init_commands() {
-	add_command("quit", func(args []string) {
+	add_command("quit", func(r *ex_range, args []string) {
 		close_current_buffer(false)
 	})
 	add_alias("q", "quit")
-	add_command("quit!", func(args []string) {
+	add_command("quit!", func(r *ex_range, args []string) {
 		close_current_buffer(true)
 	})
 	add_alias("q!", "quit!")
-	add_command("write", func(args []string) {
+	add_command("write", func(r *ex_range, args []string) {
 		b := current_view_tree.leaf.buf
-		if len(args) > 1 {
-			b.set_path(args[1])
+		// A range of every line is the same as none
+		if r != nil && (r.start > 0 || r.end < b.line_count()-1) {
+			if len(args) < 2 {
+				message_error("Can't write part of a buffer without a file name.")
+			} else {
+				write_range(b, r, args[1])
+			}
+			return
 		}
+		if len(args) < 2 {
+			b.save()
+			return
+		}
+		path, err := filepath.Abs(args[1])
+		if err != nil {
+			path = args[1]
+		}
+		if _, err := os.Stat(path); err == nil && path != b.path {
+			yes_or_no("Overwrite '"+args[1]+"'?", func(yes bool) {
+				if yes {
+					b.set_path(args[1])
+					b.save()
+				}
+			})
+			return
+		}
+		b.set_path(args[1])
 		b.save()
 	})
 	add_alias("w", "write")
-	add_command("edit", func(args []string) {
+	add_command("wall", func(r *ex_range, args []string) {
+		modified := []*buffer{}
+		for _, b := range buffers {
+			if b.modified && b.path != "" {
+				modified = append(modified, b)
+			}
+		}
+		p := make_progress_reporter("Writing buffers", 0, len(modified))
+		for i, b := range modified {
+			if err := b.write_file(); err != nil {
+				message_error("Error saving buffer '" + b.nice_path() + "': " + err.Error())
+				return
+			}
+			b.modified = false
+			undo_file_write(b)
+			p.update(i + 1)
+		}
+		p.done()
+	})
+	add_alias("wa", "wall")
+	add_command("edit", func(r *ex_range, args []string) {
 		if len(args) < 2 {
 			message_error("Can't open buffer without a name or file path.")
 		} else {
@@ -1168,23 +1511,30 @@ func init_commands() {
 	})
 	add_alias("e", "edit")
 	add_alias("o", "edit")
-	add_command("writequit", func(args []string) {
+	add_command("writequit", func(r *ex_range, args []string) {
 		run_command([]string{"write"})
 		run_command([]string{"quit"})
 	})
 	add_alias("wq", "writequit")
-	add_command("buffers", func(args []string) {
+	add_command("buffers", func(r *ex_range, args []string) {
+		if len(args) > 1 {
+			if show_buffer(args[1]) == nil {
+				message_error("No buffer named '" + args[1] + "'")
+			}
+			return
+		}
 		var b *buffer
 		if b = find_buffer("*buffers*"); b == nil {
 			b = open_buffer_named("*buffers*")
 			b.add_mode("buffers")
 		}
-		b.data = [][]rune{}
+		names := []string{}
 		for _, buf := range buffers {
 			if buf.name != "*buffers*" {
-				b.data = append(b.data, []rune(buf.name))
+				names = append(names, buf.name)
 			}
 		}
+		b.set_contents(strings.Join(names, "\n"))
 		hook_trigger_buffer("modified", b)
 		show_buffer(b.name)
 	})
@@ -1201,24 +1551,42 @@ type view_highlight struct {
 }
 
 type view struct {
-	buf            *buffer
-	line_offset    int
+	buf *buffer
+	// The buffer's cursor while the view is the active one
+	cursor      *location
+	line_offset int
+	// Display column the view starts at when lines aren't wrapped
+	col_offset     int
 	center_pending bool
 
+	last_render_width  int
+	last_render_height int
+
 	highlights []*view_highlight
 }
 
 func new_view(buf *buffer) *view {
 	return &view{
 		buf:            buf,
+		cursor:         buf.cursor.clone(),
 		line_offset:    0,
 		center_pending: false,
 		highlights:     []*view_highlight{},
 	}
 }
 
+// Makes the view's cursor the one commands move, each view of a buffer keeps
+// it's own cursor
+func (v *view) activate() {
+	v.buf.cursor = v.cursor
+}
+
 func (v *view) adjust_scroll(w, h int) {
-	l := v.buf.cursor.line
+	if w <= 0 || h <= 0 {
+		// Not rendered yet
+		return
+	}
+	l := v.cursor.line
 	if v.center_pending {
 		v.line_offset = max(l-int(math.Floor(float64(h-1)/2)), 1)
 		v.center_pending = false
@@ -1233,6 +1601,27 @@ func (v *view) adjust_scroll(w, h int) {
 	if l < v.line_offset {
 		v.line_offset = l
 	}
+
+	if config_get_bool("wrap", v.buf) {
+		// Lines taking more than one row can still push the cursor's row
+		// off screen
+		for v.line_offset < l && v.rows_to_cursor(v.line_offset, w) > h-1 {
+			v.line_offset++
+		}
+		v.col_offset = 0
+		return
+	}
+	line := v.buf.get_line(l)
+	col := display_width(line[:min(v.cursor.char, len(line))])
+	cw := 1
+	if v.cursor.char < len(line) {
+		cw = char_width(line[v.cursor.char])
+	}
+	if col < v.col_offset {
+		v.col_offset = col
+	} else if text_w := v.text_width(w); col+cw > v.col_offset+text_w {
+		v.col_offset = col + cw - text_w
+	}
 }
 
 // }}}
@@ -1246,23 +1635,90 @@ type view_tree struct {
 	bottom *view_tree
 	leaf   *view
 	size   int
+	// View the window showed before the current one
+	alternate *view
 }
 
 func new_view_tree_leaf(parent *view_tree, v *view) *view_tree {
 	return &view_tree{parent: parent, leaf: v, size: 50}
 }
 
+// Splits a leaf in two, the new window showing v goes on top (or to the left
+// when vertical) and the leaf's view moves to a new leaf. Children sizes are
+// the percentage of their parent's space they take.
+func (vt *view_tree) split(v *view, vertical bool) *view_tree {
+	old := new_view_tree_leaf(vt, vt.leaf)
+	old.alternate = vt.alternate
+	created := new_view_tree_leaf(vt, v)
+	vt.leaf = nil
+	vt.alternate = nil
+	if vertical {
+		vt.left, vt.right = created, old
+	} else {
+		vt.top, vt.bottom = created, old
+	}
+	return created
+}
+
+// Shows b in the window, it's previous view becomes the alternate one. When
+// b is the alternate buffer it's view is reused, keeping it's cursor and
+// scroll position.
+func (vt *view_tree) show(b *buffer) {
+	v := vt.alternate
+	if v == nil || v.buf != b {
+		v = new_view(b)
+	}
+	vt.alternate = vt.leaf
+	vt.leaf = v
+	v.activate()
+}
+
+// Buffer of the alternate view if it is still open
+func (vt *view_tree) alternate_buffer() *buffer {
+	if vt.alternate == nil || vt.alternate.buf == vt.leaf.buf {
+		return nil
+	}
+	for _, b := range buffers {
+		if b == vt.alternate.buf {
+			return b
+		}
+	}
+	return nil
+}
+
+// Width of the left window of a vertical split w columns wide, one column
+// is left between the windows for the separator
+func (vt *view_tree) left_width(w int) int {
+	return max(min((w-1)*vt.left.size/100, w-2), 1)
+}
+
+func (vt *view_tree) top_height(h int) int {
+	return max(min(h*vt.top.size/100, h-2), 2)
+}
+
+// Calls f with the screen position of every node, children first
+func (vt *view_tree) layout(x, y, w, h int, f func(vt *view_tree, x, y, w, h int)) {
+	if vt.left != nil {
+		lw := vt.left_width(w)
+		vt.left.layout(x, y, lw, h, f)
+		vt.right.layout(x+lw+1, y, w-lw-1, h, f)
+	} else if vt.top != nil {
+		th := vt.top_height(h)
+		vt.top.layout(x, y, w, th, f)
+		vt.bottom.layout(x, y+th, w, h-th, f)
+	}
+	f(vt, x, y, w, h)
+}
+
 // }}}
 
 // {{{ message
 func message(m string) {
-	editor_message = m
-	editor_message_type = "info"
+	message_at_level(message_level_info, m)
 }
 
 func message_error(m string) {
-	editor_message = m
-	editor_message_type = "error"
+	message_at_level(message_level_error, m)
 }
 
 // }}}
@@ -1274,6 +1730,20 @@ func style(name string) tcell.Style {
 		return tcell.StyleDefault.
 			Foreground(tcell.ColorMaroon)
 	}
+	if name == "message.warning" {
+		return tcell.StyleDefault.
+			Foreground(tcell.ColorOlive)
+	}
+	if name == "completion" {
+		return tcell.StyleDefault.
+			Foreground(tcell.ColorWhite).
+			Background(tcell.Color(6))
+	}
+	if name == "completion.current" {
+		return tcell.StyleDefault.
+			Foreground(tcell.ColorWhite).
+			Background(tcell.Color(5))
+	}
 	if name == "statusbar" {
 		return tcell.StyleDefault.
 			Foreground(tcell.ColorWhite).
@@ -1284,15 +1754,50 @@ func style(name string) tcell.Style {
 			Foreground(tcell.ColorWhite).
 			Background(tcell.Color(5))
 	}
+	if name == "tabline" {
+		return tcell.StyleDefault.
+			Foreground(tcell.ColorWhite).
+			Background(tcell.Color(6))
+	}
+	if name == "tabline.current" {
+		return tcell.StyleDefault.
+			Foreground(tcell.ColorWhite).
+			Background(tcell.Color(5))
+	}
+	if name == "wrap_indicator" {
+		return tcell.StyleDefault.
+			Foreground(tcell.Color(6))
+	}
+	if name == "separator" {
+		return tcell.StyleDefault.
+			Foreground(tcell.Color(6))
+	}
 	if name == "linenumber" {
 		return tcell.StyleDefault.
 			Foreground(tcell.Color(6))
 	}
+	if name == "linenumber.current" {
+		return tcell.StyleDefault.
+			Foreground(tcell.ColorWhite)
+	}
+	if name == "sign.error" {
+		return tcell.StyleDefault.
+			Foreground(tcell.ColorMaroon)
+	}
+	if name == "sign.info" {
+		return tcell.StyleDefault.
+			Foreground(tcell.Color(6))
+	}
 	if name == "search" {
 		return tcell.StyleDefault.
 			Foreground(tcell.ColorWhite).
 			Background(tcell.ColorOlive)
 	}
+	if name == "substitute" {
+		return tcell.StyleDefault.
+			Foreground(tcell.ColorWhite).
+			Background(tcell.ColorMaroon)
+	}
 	if name == "visual" {
 		return tcell.StyleDefault.
 			Foreground(tcell.ColorWhite).
@@ -1336,7 +1841,15 @@ func render() {
 
 	screen.Clear()
 
-	render_view_tree(root_view_tree, 0, 0, width, height-1)
+	if len(tabs) > 1 {
+		render_tab_line(width)
+	}
+	x, y, w, h := window_area()
+	if window_zoomed {
+		render_view_tree(current_view_tree, x, y, w, h)
+	} else {
+		render_view_tree(root_view_tree, x, y, w, h)
+	}
 
 	render_message_bar(width, height)
 
@@ -1347,18 +1860,46 @@ func render_message_bar(width, height int) {
 	s := style("default")
 
 	if editor_mode == "prompt" {
-		p := editor_prompt + editor_prompt_value
+		if len(completion_items) > 0 {
+			render_completion_menu(height-2, width)
+		}
+		value := []rune(editor_prompt_value)
+		x := write(s, 0, height-1, editor_prompt+string(value[:editor_prompt_cursor]))
+		cursor_char := " "
+		if prompt_register_pending {
+			cursor_char = "\""
+		} else if editor_prompt_cursor < len(value) {
+			cursor_char = string(value[editor_prompt_cursor])
+		}
+		x += write(s.Reverse(true), x, height-1, cursor_char)
+		if editor_prompt_cursor < len(value) {
+			write(s, x, height-1, string(value[editor_prompt_cursor+1:]))
+		}
+		return
+	}
+	if editor_mode == "choice" {
+		p := choice_prompt_text()
 		write(s, 0, height-1, p)
 		write(s.Reverse(true), len(p), height-1, " ")
 		return
 	}
 
 	smb := s
-	if editor_message_type == "error" {
-		smb = style("message.error")
+	if editor_message_type == "error" || editor_message_type == "warning" {
+		smb = style("message." + editor_message_type)
+	}
+	if lines := message_lines(width); len(lines) > 1 {
+		for i, line := range lines {
+			write(smb, 0, height-len(lines)+i, line)
+		}
+		return
 	}
 	if editor_message != "" {
 		write(smb, 0, height-1, editor_message)
+	} else if keys_count > 0 {
+		write(smb, 0, height-1, strconv.Itoa(keys_count)+" "+keys_entered.String())
+	} else if len(keys_entered.keys) == 0 && macro_recording_register != 0 {
+		write(smb, 0, height-1, "recording @"+string(macro_recording_register))
 	} else {
 		write(smb, 0, height-1, keys_entered.String())
 	}
@@ -1366,70 +1907,103 @@ func render_message_bar(width, height int) {
 	write(s, width-len(last_key_text)-1, height-1, last_key_text)
 }
 
-func render_view_tree(vt *view_tree, x, y, w, h int) {
-	if vt.leaf != nil {
-		render_view(vt.leaf, x, y, w, h)
-		return
+func render_tab_line(width int) {
+	s := style("tabline")
+	x := 0
+	for i, label := range tab_labels() {
+		if i == current_tab {
+			x += write(style("tabline.current"), x, 0, label)
+		} else {
+			x += write(s, x, 0, label)
+		}
+	}
+	if x < width {
+		write(s, x, 0, strings.Repeat(" ", width-x))
 	}
-	panic("unreachable")
+}
+
+func render_view_tree(vt *view_tree, x, y, w, h int) {
+	vt.layout(x, y, w, h, func(vt *view_tree, x, y, w, h int) {
+		if vt.leaf != nil {
+			render_view(vt.leaf, x, y, w, h)
+		} else if vt.left != nil {
+			sx := x + vt.left_width(w)
+			for sy := y; sy < y+h; sy++ {
+				write(style("separator"), sx, sy, "│")
+			}
+		}
+	})
 }
 
 func render_view(v *view, x, y, w, h int) {
 	sc := style("cursor")
-	sln := style("linenumber")
-	ssb := style("statusbar")
-	ssbh := style("statusbar.highlight")
 	b := v.buf
 
-	b.last_render_width = w
-	b.last_render_height = h
+	v.last_render_width = w
+	v.last_render_height = h
+	v.adjust_scroll(w, h)
 
 	style_map := highlighting_styles(b)
 
-	gutterw := len(strconv.Itoa(len(b.data))) + 1
+	line_count := b.line_count()
+	gutterw := v.gutter_width()
+	text_w := v.text_width(w)
+	wrap := config_get_bool("wrap", b)
+	indicator := config_get("wrap_indicator", b)
+	is_current := v == current_view_tree.leaf
 	sy := y
 	line := v.line_offset
-	for line < len(b.data) && sy < y+h-1 {
-		write(sln, x, sy, padl(strconv.Itoa(line+1), gutterw-1, ' '))
-
-		sx := x + gutterw
-		for c, char := range b.data[line] {
-			if v == current_view_tree.leaf && line == b.cursor.line && c == b.cursor.char {
-				sx += write(sc, sx, sy, string(char))
+	for line < line_count && sy < y+h-1 {
+		line_data := b.get_line(line)
+		rows := v.line_rows(line, w)
+		for r, beg := range rows {
+			if sy >= y+h-1 {
+				break
+			}
+			end := len(line_data)
+			if r+1 < len(rows) {
+				end = rows[r+1]
+			}
+			sx := x + gutterw
+			if r == 0 {
+				render_gutter(v, x, sy, line)
 			} else {
-				sx += write(style_map[line][c], sx, sy, string(char))
+				sx += write(style("wrap_indicator"), sx, sy, indicator)
 			}
-			if sx >= x+w {
-				break
+
+			// Display column in the line, chars left of col_offset are
+			// scrolled out of view
+			col := 0
+			for c := beg; c < end; c++ {
+				cw := char_width(line_data[c])
+				if !wrap && col < v.col_offset {
+					col += cw
+					continue
+				}
+				if !wrap && col+cw-v.col_offset > text_w {
+					break
+				}
+				if !wrap {
+					sx = x + gutterw + col - v.col_offset
+				}
+				st := style_map[line][c]
+				if is_current && line == v.cursor.line && c == v.cursor.char {
+					st = sc
+				}
+				write(st, sx, sy, string(line_data[c]))
+				sx += cw
+				col += cw
 			}
+			if is_current && line == v.cursor.line && r == len(rows)-1 &&
+				v.cursor.char == len(line_data) && sx < x+w {
+				write(sc, sx, sy, " ")
+			}
+			sy++
 		}
-		if v == current_view_tree.leaf &&
-			line == b.cursor.line &&
-			b.cursor.char == len(b.data[b.cursor.line]) {
-			write(sc, sx, sy, " ")
-		}
-
 		line++
-		sy++
-	}
-
-	// Current mode
-	mode_status := editor_mode
-	for _, mode_name := range b.modes {
-		mode_status += "+" + mode_name
 	}
-	mode_status = " " + mode_status + " "
-	write(ssbh, x, y+h-1, mode_status)
 
-	// Position
-	status_right := fmt.Sprintf("(%d,%d) %d ", b.cursor.char+1, b.cursor.line+1, len(b.data))
-	write(ssb, x+w-len(status_right), y+h-1, status_right)
-	// File name
-	status_left := " " + b.name
-	if b.modified {
-		status_left += " [+]"
-	}
-	write(ssb, x+len(mode_status), y+h-1, padr(status_left, w-len(status_right)-len(mode_status), ' '))
+	render_status_line(v, x, y+h-1, w)
 }
 
 // }}}
@@ -1477,6 +2051,9 @@ func init_views() {
 	view := new_view(buffers[0])
 	root_view_tree = &view_tree{leaf: view}
 	current_view_tree = root_view_tree
+	view.activate()
+	tabs = []*tab_page{&tab_page{root: root_view_tree, current: current_view_tree}}
+	current_tab = 0
 }
 
 // }}}
@@ -1495,6 +2072,60 @@ const (
 	key_type_alpha_num
 )
 
+// Names of the keys that aren't runes, F1 to F64 are named F1 to F64 and any
+// other key KEY followed by it's number so that every key can be written as
+// text and read back (macros are stored that way)
+var key_names = map[tcell.Key]string{
+	tcell.KeyDelete:     "DEL",
+	tcell.KeyBackspace2: "BAK",
+	tcell.KeyEnter:      "RET",
+	tcell.KeyEscape:     "ESC",
+	tcell.KeyTab:        "TAB",
+	tcell.KeyLeft:       "LEFT",
+	tcell.KeyRight:      "RIGHT",
+	tcell.KeyUp:         "UP",
+	tcell.KeyDown:       "DOWN",
+	tcell.KeyHome:       "HOME",
+	tcell.KeyEnd:        "END",
+	tcell.KeyPgUp:       "PGUP",
+	tcell.KeyPgDn:       "PGDN",
+	tcell.KeyInsert:     "INS",
+	key_type_catchall:   "$any",
+	key_type_alpha:      "$alpha",
+	key_type_num:        "$num",
+	key_type_alpha_num:  "$alphanum",
+}
+
+func key_name(k tcell.Key) string {
+	if name, ok := key_names[k]; ok {
+		return name
+	}
+	if k >= tcell.KeyF1 && k <= tcell.KeyF64 {
+		return "F" + strconv.Itoa(int(k-tcell.KeyF1)+1)
+	}
+	return "KEY" + strconv.Itoa(int(k))
+}
+
+// Key named name, false when it is a rune
+func key_from_name(name string) (tcell.Key, bool) {
+	for k, n := range key_names {
+		if n == name {
+			return k, true
+		}
+	}
+	if strings.HasPrefix(name, "F") {
+		if n, err := strconv.Atoi(name[1:]); err == nil && n >= 1 && n <= 64 {
+			return tcell.KeyF1 + tcell.Key(n-1), true
+		}
+	}
+	if strings.HasPrefix(name, "KEY") {
+		if n, err := strconv.Atoi(name[3:]); err == nil {
+			return tcell.Key(n), true
+		}
+	}
+	return 0, false
+}
+
 func new_key_from_event(ev *tcell.EventKey) *key {
 	k, r, m := ev.Key(), ev.Rune(), ev.Modifiers()
 
@@ -1515,21 +2146,19 @@ func new_key_from_event(ev *tcell.EventKey) *key {
 		r = 0
 	}
 
+	if k == tcell.KeyBacktab {
+		return &key{mod: ev.Modifiers() | tcell.ModShift, key: tcell.KeyTab}
+	}
+
 	return &key{mod: ev.Modifiers(), key: k, chr: r}
 }
 
 func new_key(rep string) *key {
-	if rep == "$any" {
-		return &key{key: key_type_catchall}
-	} else if rep == "$num" {
-		return &key{key: key_type_num}
-	} else if rep == "$alpha" {
-		return &key{key: key_type_alpha}
-	} else if rep == "$alphanum" {
-		return &key{key: key_type_alpha_num}
-	}
-
 	parts := strings.Split(rep, "-")
+	if strings.HasSuffix(rep, "-") {
+		// The minus key itself ("-" or "C--")
+		parts = append(parts[:len(parts)-2], "-")
+	}
 
 	// Modifiers
 	mod_mask := tcell.ModNone
@@ -1548,24 +2177,13 @@ func new_key(rep string) *key {
 
 	// Key
 	var r rune = 0
-	var k tcell.Key
+	k := tcell.KeyRune
 	last_part := parts[len(parts)-1]
-	switch last_part {
-	case "DEL":
-		k = tcell.KeyDelete
-	case "BAK":
-		k = tcell.KeyBackspace2
-	case "RET":
-		k = tcell.KeyEnter
-	case "SPC":
-		k = tcell.KeyRune
+	if named, ok := key_from_name(last_part); ok {
+		k = named
+	} else if last_part == "SPC" {
 		r = ' '
-	case "ESC":
-		k = tcell.KeyEscape
-	case "TAB":
-		k = tcell.KeyTab
-	default:
-		k = tcell.KeyRune
+	} else {
 		r = []rune(last_part)[0]
 	}
 
@@ -1588,19 +2206,9 @@ func (k *key) String() string {
 	}
 
 	name := string(k.chr)
-	switch k.key {
-	case tcell.KeyDelete:
-		name = "DEL"
-	case tcell.KeyBackspace2:
-		name = "BAK"
-	case tcell.KeyEnter:
-		name = "RET"
-	case tcell.KeyEscape:
-		name = "ESC"
-	case tcell.KeyTab:
-		name = "TAB"
-	}
-	if k.key == tcell.KeyRune && k.chr == ' ' {
+	if k.key != tcell.KeyRune {
+		name = key_name(k.key)
+	} else if k.chr == ' ' {
 		name = "SPC"
 	}
 
@@ -1633,10 +2241,12 @@ func (k1 *key) matches(k2 *key) bool {
 
 type key_list struct {
 	keys []*key
+	// Count typed before the keys, 0 when none was given
+	count int
 }
 
 func new_key_list(rep string) *key_list {
-	kl := &key_list{[]*key{}}
+	kl := &key_list{keys: []*key{}}
 	parts := strings.Split(rep, " ")
 	for _, part := range parts {
 		if part != "" {
@@ -1656,10 +2266,29 @@ func (kl *key_list) String() string {
 	return strings.Join(rep, " ")
 }
 
+// Number of times a command should be repeated, 1 unless a count was given
+func (kl *key_list) times() int {
+	if kl == nil || kl.count <= 0 {
+		return 1
+	}
+	return kl.count
+}
+
 func (kl *key_list) add_key(k *key) {
 	kl.keys = append(kl.keys, k)
 }
 
+// Number of keys matching any key of a kind ($any, $alpha, $num)
+func (kl *key_list) wildcards() int {
+	n := 0
+	for _, k := range kl.keys {
+		if k.key == key_type_catchall || k.key == key_type_alpha || k.key == key_type_num {
+			n++
+		}
+	}
+	return n
+}
+
 func (kl1 *key_list) matches(kl2 *key_list) bool {
 	if len(kl1.keys) != len(kl2.keys) {
 		return false
@@ -1674,7 +2303,7 @@ func (kl1 *key_list) matches(kl2 *key_list) bool {
 
 func (kl1 *key_list) has_suffix(kl2 *key_list) *key_list {
 	for i := len(kl1.keys) - 1; i >= 0; i-- {
-		tmp_kl := key_list{kl1.keys[i:]}
+		tmp_kl := key_list{keys: kl1.keys[i:]}
 		if tmp_kl.matches(kl2) {
 			return &tmp_kl
 		}
@@ -1712,17 +2341,18 @@ func write(style tcell.Style, x, y int, str string) int {
 	var deferred []rune
 	dwidth := 0
 	for _, r := range str {
-		// Handle tabs
+		// Handle tabs, they take char_width cells like when wrapping
 		if r == '\t' {
-			// TODO setting
-			tab_width := int(config_get_number("tab_width", nil))
+			if len(deferred) != 0 {
+				s.SetContent(x+i, y, deferred[0], deferred[1:], style)
+				i += dwidth
+			}
 
 			// Print first tab char
 			s.SetContent(x+i, y, '>', nil, style.Foreground(tcell.ColorAqua))
 			i++
 
-			// Add space till we reach tab column or tab_width
-			for j := 0; j < tab_width-1 || i%tab_width == tab_width-1; j++ {
+			for j := 1; j < char_width(r); j++ {
 				s.SetContent(x+i, y, ' ', nil, style)
 				i++
 			}
@@ -1773,6 +2403,15 @@ func list_contains_string(list []string, search string) bool {
 	return false
 }
 
+func list_contains_rune(list []rune, search rune) bool {
+	for _, item := range list {
+		if item == search {
+			return true
+		}
+	}
+	return false
+}
+
 func padr(str string, length int, padding rune) string {
 	for utf8.RuneCountInString(str) < length {
 		str = str + string(padding)
@@ -1780,6 +2419,13 @@ func padr(str string, length int, padding rune) string {
 	return str
 }
 
+func truncate(str string, length int) string {
+	if utf8.RuneCountInString(str) <= length {
+		return str
+	}
+	return string([]rune(str)[:max(length, 0)])
+}
+
 func padl(str string, length int, padding rune) string {
 	for utf8.RuneCountInString(str) < length {
 		str = string(padding) + str
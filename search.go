@@ -2,7 +2,6 @@ package main
 
 import (
 	"regexp"
-	"strings"
 )
 
 var (
@@ -15,14 +14,14 @@ var (
 
 func init_search() {
 	bind("normal", k("/"), handle_search_start)
-	bind("normal", k("N"), handle_search_prev)
-	bind("normal", k("n"), handle_search_next)
-	bind("normal", k("*"), handle_search_search_work_under_cursor)
+	bind_motion("N", motion_exclusive, handle_search_prev)
+	bind_motion("n", motion_exclusive, handle_search_next)
+	bind_motion("*", motion_exclusive, handle_search_search_work_under_cursor)
 	bind("normal", k("SPC n"), func(vt *view_tree, b *buffer, kl *key_list) {
 		search_clear()
 	})
 
-	add_command("clearsearch", func(args []string) {
+	add_command("clearsearch", func(r *ex_range, args []string) {
 		search_clear()
 	})
 	add_alias("cs", "clearsearch")
@@ -32,23 +31,42 @@ func init_search() {
 		if last_search != "" && b == last_search_buffer {
 			search_find_matches(b, last_search)
 			last_search_index = len(last_search_results) - 1
+			search_signs()
 		}
 	})
 }
 
 func search_clear() {
 	last_search_highlight = false
+	search_signs()
 	highlight_buffer(current_view_tree.leaf.buf)
 }
 
+// Marks the lines with highlighted search results in the sign column
+func search_signs() {
+	for _, b := range buffers {
+		sign_clear(b, "search")
+	}
+	if !last_search_highlight || last_search_buffer == nil {
+		return
+	}
+	line := -1
+	for _, loc := range last_search_results {
+		if loc.line != line {
+			sign_place(last_search_buffer, "search", loc.line, '/', "sign.info")
+			line = loc.line
+		}
+	}
+}
+
 func search_find_matches(b *buffer, search string) {
 	last_search = search
 	re := regexp.MustCompile(regexp.QuoteMeta(search))
 
 	last_search_buffer = b
 	last_search_results = []*location{}
-	for i, line := range b.data {
-		idxs := re.FindAllStringIndex(string(line), -1)
+	for i := 0; i < b.line_count(); i++ {
+		idxs := re.FindAllStringIndex(string(b.get_line(i)), -1)
 		for _, idx := range idxs {
 			last_search_results = append(last_search_results, new_location(i, idx[0]))
 		}
@@ -66,8 +84,8 @@ func search_start(b *buffer, search string) {
 }
 
 func handle_search_start(vt *view_tree, b *buffer, kl *key_list) {
-	prompt("/", noop_complete, func(args []string) {
-		search_start(b, strings.Join(args, " "))
+	prompt("/", noop_complete, func(search string) {
+		search_start(b, search)
 	})
 }
 
@@ -82,6 +100,7 @@ func search_prev(b *buffer) {
 		last_search_index--
 	}
 	last_search_highlight = true
+	search_signs()
 	highlight_buffer(current_view_tree.leaf.buf)
 	loc := last_search_results[last_search_index]
 	b.move_to(loc.char, loc.line)
@@ -89,7 +108,9 @@ func search_prev(b *buffer) {
 }
 
 func handle_search_prev(vt *view_tree, b *buffer, kl *key_list) {
-	search_prev(b)
+	for i := 0; i < kl.times(); i++ {
+		search_prev(b)
+	}
 }
 
 func search_next(b *buffer) {
@@ -103,6 +124,7 @@ func search_next(b *buffer) {
 		last_search_index++
 	}
 	last_search_highlight = true
+	search_signs()
 	highlight_buffer(current_view_tree.leaf.buf)
 	loc := last_search_results[last_search_index]
 	b.move_to(loc.char, loc.line)
@@ -110,7 +132,9 @@ func search_next(b *buffer) {
 }
 
 func handle_search_next(vt *view_tree, b *buffer, kl *key_list) {
-	search_next(b)
+	for i := 0; i < kl.times(); i++ {
+		search_next(b)
+	}
 }
 
 func search_highlight(b *buffer, l, c int) int {
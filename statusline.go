@@ -0,0 +1,223 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The status line of each window is built from the status_line option,
+// {segment} is replaced by the segment's text and {=} separates the left
+// aligned part from the right aligned one. A space following a segment that
+// is empty is dropped.
+//
+// Segments are hooks (hook_status_segment) so that any part of the editor can
+// add a segment or add it's text to an existing one.
+
+type status_segment_fn func(v *view) string
+
+type status_part struct {
+	text  string
+	style string
+}
+
+// Encoding and line endings of a buffer, found when it is first shown and
+// again after it is read or written (not on every edit, that would scan the
+// whole buffer each time)
+type buffer_format struct {
+	encoding     string
+	line_endings string
+}
+
+var buffer_formats = map[*buffer]*buffer_format{}
+
+func init_status_line() {
+	forget_format := func(b *buffer) {
+		delete(buffer_formats, b)
+	}
+	hook_buffer("loaded", forget_format)
+	hook_buffer("saved", forget_format)
+
+	hook_status_segment("mode", func(v *view) string {
+		modes := v.buf.modes
+		if v == current_view_tree.leaf {
+			modes = append([]string{editor_mode}, modes...)
+		}
+		return " " + strings.Join(modes, "+") + " "
+	})
+	hook_status_segment("name", func(v *view) string {
+		return v.buf.name
+	})
+	hook_status_segment("modified", func(v *view) string {
+		if v.buf.modified {
+			return " [+]"
+		}
+		return ""
+	})
+	hook_status_segment("filetype", func(v *view) string {
+		return strings.TrimPrefix(filepath.Ext(v.buf.path), ".")
+	})
+	hook_status_segment("encoding", func(v *view) string {
+		return get_buffer_format(v.buf).encoding
+	})
+	hook_status_segment("line_endings", func(v *view) string {
+		return get_buffer_format(v.buf).line_endings
+	})
+	hook_status_segment("percent", func(v *view) string {
+		return strconv.Itoa((v.cursor.line+1)*100/v.buf.line_count()) + "%"
+	})
+	hook_status_segment("col", func(v *view) string {
+		return strconv.Itoa(v.cursor.char + 1)
+	})
+	hook_status_segment("line", func(v *view) string {
+		return strconv.Itoa(v.cursor.line + 1)
+	})
+	hook_status_segment("lines", func(v *view) string {
+		return strconv.Itoa(v.buf.line_count())
+	})
+	hook_status_segment("selection", func(v *view) string {
+		b := v.buf
+		if v != current_view_tree.leaf || !b.is_in_mode("visual") && !b.is_in_mode("visual-line") {
+			return ""
+		}
+		text, l1, l2 := visual_mode_selection(b)
+		if l1.line != l2.line {
+			return strconv.Itoa(l2.line-l1.line+1) + " lines"
+		}
+		return strconv.Itoa(len(text)) + " chars"
+	})
+	hook_status_segment("search", func(v *view) string {
+		if v.buf != last_search_buffer || !last_search_highlight || len(last_search_results) == 0 {
+			return ""
+		}
+		return "[" + strconv.Itoa(last_search_index+1) + "/" + strconv.Itoa(len(last_search_results)) + "]"
+	})
+	hook_status_segment("keys", func(v *view) string {
+		if v != current_view_tree.leaf {
+			return ""
+		}
+		keys := keys_entered.String()
+		if keys_count > 0 {
+			keys = strings.TrimSpace(strconv.Itoa(keys_count) + " " + keys)
+		}
+		return keys
+	})
+}
+
+func get_buffer_format(b *buffer) *buffer_format {
+	if _, ok := buffer_formats[b]; !ok {
+		buffer_formats[b] = detect_buffer_format(b)
+	}
+	return buffer_formats[b]
+}
+
+// Encoding is utf-8, utf-8-bom when the text starts with a byte order mark
+// or ascii when it only has ascii chars. Line endings are dos when every
+// line ends with \r (the last one may not), mixed when only some do and unix
+// otherwise.
+func detect_buffer_format(b *buffer) *buffer_format {
+	ascii := true
+	crlf := 0
+	count := b.line_count()
+	for l := 0; l < count; l++ {
+		line := b.get_line(l)
+		for _, r := range line {
+			if r >= 0x80 {
+				ascii = false
+				break
+			}
+		}
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			crlf++
+		}
+	}
+
+	f := &buffer_format{encoding: "utf-8", line_endings: "mixed"}
+	if first := b.get_line(0); len(first) > 0 && first[0] == '\uFEFF' {
+		f.encoding = "utf-8-bom"
+	} else if ascii {
+		f.encoding = "ascii"
+	}
+	last := b.get_line(count - 1)
+	last_crlf := len(last) > 0 && last[len(last)-1] == '\r'
+	if crlf == 0 {
+		f.line_endings = "unix"
+	} else if crlf == count || crlf == count-1 && !last_crlf {
+		f.line_endings = "dos"
+	}
+	return f
+}
+
+// Expands a status line format, returning the left and right aligned parts
+func status_line_parts(v *view, format string) ([]*status_part, []*status_part) {
+	left, right := []*status_part{}, []*status_part{}
+	parts := &left
+	skip_space := false
+	for len(format) > 0 {
+		i := strings.IndexByte(format, '{')
+		j := strings.IndexByte(format, '}')
+		if i == -1 || j < i {
+			i = len(format)
+		}
+		if i > 0 {
+			text := format[:i]
+			if skip_space {
+				text = strings.TrimPrefix(text, " ")
+			}
+			*parts = append(*parts, &status_part{text: text, style: "statusbar"})
+			format = format[i:]
+			skip_space = false
+			continue
+		}
+
+		name := format[1:j]
+		format = format[j+1:]
+		skip_space = false
+		if name == "=" {
+			parts = &right
+			continue
+		}
+		text, ok := hook_trigger_status_segment(name, v)
+		if !ok {
+			continue
+		}
+		if text == "" {
+			skip_space = true
+			continue
+		}
+		part := &status_part{text: text, style: "statusbar"}
+		if name == "mode" && v == current_view_tree.leaf {
+			part.style = "statusbar.highlight"
+		}
+		*parts = append(*parts, part)
+	}
+	return left, right
+}
+
+func status_parts_width(parts []*status_part) int {
+	w := 0
+	for _, p := range parts {
+		w += display_width([]rune(p.text))
+	}
+	return w
+}
+
+// Renders the status line on row y, the right part is dropped when the
+// window is too narrow for both
+func render_status_line(v *view, x, y, w int) {
+	left, right := status_line_parts(v, config_get("status_line", v.buf))
+	if status_parts_width(left)+status_parts_width(right) > w {
+		right = nil
+	}
+	write(style("statusbar"), x, y, strings.Repeat(" ", w))
+
+	sx := x
+	for _, p := range left {
+		text := truncate(p.text, x+w-sx)
+		sx += write(style(p.style), sx, y, text)
+	}
+	sx = x + w - status_parts_width(right)
+	for _, p := range right {
+		sx += write(style(p.style), sx, y, p.text)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// :[range]s/pattern/replacement/flags replaces matches of a Go regexp in the
+// range's lines. In the replacement $1, ${name} or \1 insert capture groups
+// and \n a new line. Flags are g (every match of a line instead of the
+// first), i (ignore case) and c (confirm each replacement with y/n/a/q).
+//
+// The whole substitution is undone at once. Without a pattern the last
+// substitution is repeated.
+
+type substitution struct {
+	b        *buffer
+	re       *regexp.Regexp
+	template string
+	global   bool
+	// Line being substituted and the range's last line
+	line, end int
+	count     int
+	lines     map[int]bool
+	last_line int
+	// Matches of the line as it was before any replacement (byte indexes),
+	// the next one to replace and how far replacements moved the rest of
+	// the line (in runes)
+	orig    string
+	matches [][]int
+	index   int
+	offset  int
+	// Current match, waiting for confirmation and highlighted with c
+	match_line, match_beg, match_end int
+}
+
+var (
+	last_substitute_pattern  = ""
+	last_substitute_template = ""
+	current_substitution     *substitution
+)
+
+func init_substitute() {
+	add_command("substitute", command_substitute)
+	add_alias("s", "substitute")
+	raw_arg_commands["substitute"] = true
+}
+
+// Splits /pattern/replacement/flags on it's delimiter (the first char),
+// escaped delimiters are kept as the delimiter itself
+func parse_substitute(arg string) (string, string, string, error) {
+	arg = strings.TrimLeft(arg, " ")
+	if arg == "" {
+		return "", "", "", nil
+	}
+	r := []rune(arg)
+	delim := r[0]
+	parts := []string{}
+	part := []rune{}
+	for i := 1; i < len(r); i++ {
+		switch {
+		case r[i] == '\\' && i+1 < len(r) && r[i+1] == delim:
+			part = append(part, delim)
+			i++
+		case r[i] == '\\' && i+1 < len(r):
+			part = append(part, r[i], r[i+1])
+			i++
+		case r[i] == delim && len(parts) < 2:
+			parts = append(parts, string(part))
+			part = []rune{}
+		default:
+			part = append(part, r[i])
+		}
+	}
+	parts = append(parts, string(part))
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	if parts[0] == "" {
+		return "", "", "", errors.New("Empty pattern")
+	}
+	// Spaces after the flags (:s/a/b/g ) are ignored
+	return parts[0], parts[1], strings.TrimSpace(parts[2]), nil
+}
+
+// Converts \1, \n, \t and \\ in a replacement to the regexp package's syntax
+func substitute_template(s string) string {
+	r := []rune(s)
+	out := []rune{}
+	for i := 0; i < len(r); i++ {
+		if r[i] != '\\' || i+1 == len(r) {
+			out = append(out, r[i])
+			continue
+		}
+		i++
+		switch {
+		case is_num(r[i]):
+			out = append(out, []rune("${"+string(r[i])+"}")...)
+		case r[i] == 'n':
+			out = append(out, '\n')
+		case r[i] == 't':
+			out = append(out, '\t')
+		case r[i] == '$':
+			out = append(out, '$', '$')
+		default:
+			out = append(out, r[i])
+		}
+	}
+	return string(out)
+}
+
+func command_substitute(r *ex_range, args []string) {
+	arg := ""
+	if len(args) > 1 {
+		arg = args[1]
+	}
+	pattern, template, flags, err := parse_substitute(arg)
+	if err != nil {
+		message_error(err.Error())
+		return
+	}
+	if pattern == "" {
+		if last_substitute_pattern == "" {
+			message_error("No previous substitution")
+			return
+		}
+		pattern, template = last_substitute_pattern, last_substitute_template
+	}
+	for _, f := range flags {
+		if !strings.ContainsRune("gic", f) {
+			message_error("Unknown flag '" + string(f) + "'")
+			return
+		}
+	}
+	last_substitute_pattern, last_substitute_template = pattern, template
+	if strings.ContainsRune(flags, 'i') {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		message_error("Invalid pattern: " + err.Error())
+		return
+	}
+
+	b := current_view_tree.leaf.buf
+	r = range_or_line(r, b)
+	s := &substitution{
+		b:        b,
+		re:       re,
+		template: substitute_template(template),
+		global:   strings.ContainsRune(flags, 'g'),
+		line:     r.start,
+		end:      r.end,
+		lines:    map[int]bool{},
+	}
+	b.begin_change_group()
+	if strings.ContainsRune(flags, 'c') {
+		current_substitution = s
+		s.confirm_next()
+		return
+	}
+	for s.next() {
+		s.replace()
+	}
+	s.done()
+}
+
+// Finds the next match, returns false when there are no more in the range.
+// Every match of a line is found before replacing any of them so that ^ or
+// \b don't match text replacements created.
+func (s *substitution) next() bool {
+	for s.line <= s.end {
+		if s.matches == nil {
+			s.orig = string(s.b.get_line(s.line))
+			s.matches = s.re.FindAllStringSubmatchIndex(s.orig, -1)
+			if !s.global && len(s.matches) > 1 {
+				s.matches = s.matches[:1]
+			}
+			s.index, s.offset = 0, 0
+		}
+		if s.index < len(s.matches) {
+			m := s.matches[s.index]
+			s.match_line = s.line
+			s.match_beg = utf8.RuneCountInString(s.orig[:m[0]]) + s.offset
+			s.match_end = s.match_beg + utf8.RuneCountInString(s.orig[m[0]:m[1]])
+			return true
+		}
+		s.line++
+		s.matches = nil
+	}
+	return false
+}
+
+// Replaces the current match
+func (s *substitution) replace() {
+	b := s.b
+	m := s.matches[s.index]
+	replacement := []rune(string(s.re.ExpandString(nil, s.template, s.orig, m)))
+
+	b.remove_at(new_location(s.match_line, s.match_beg), s.match_end-s.match_beg)
+	b.move_to(s.match_beg, s.match_line)
+	b.insert(replacement)
+	s.count++
+	s.lines[s.match_line] = true
+	s.last_line = s.match_line
+
+	// The rest of the line moved by the replacement, new lines in it add
+	// lines to the range
+	orig_end := utf8.RuneCountInString(s.orig[:m[1]])
+	s.offset = s.match_beg + len(replacement) - orig_end
+	for i, r := range replacement {
+		if r == '\n' {
+			s.line++
+			s.end++
+			s.offset = len(replacement) - i - 1 - orig_end
+		}
+	}
+	s.index++
+}
+
+// Moves past the current match without replacing it
+func (s *substitution) skip() {
+	s.index++
+}
+
+func (s *substitution) confirm_next() {
+	if !s.next() {
+		s.done()
+		return
+	}
+	s.b.move_to(s.match_beg, s.match_line)
+	highlight_buffer(s.b)
+	prompt_choice("Replace with '"+last_substitute_template+"'?", []rune("ynaq"), func(answer rune) {
+		switch answer {
+		case 'y':
+			s.replace()
+			s.confirm_next()
+		case 'n':
+			s.skip()
+			s.confirm_next()
+		case 'a':
+			for {
+				s.replace()
+				if !s.next() {
+					break
+				}
+			}
+			s.done()
+		default:
+			s.done()
+		}
+	})
+}
+
+func (s *substitution) done() {
+	current_substitution = nil
+	s.b.end_change_group()
+	highlight_buffer(s.b)
+	if s.count == 0 {
+		message_error("Pattern not found: " + last_substitute_pattern)
+		return
+	}
+	s.b.move_to(0, s.last_line)
+	message(plural(s.count, "substitution") + " on " + plural(len(s.lines), "line"))
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return strconv.Itoa(n) + " " + word + "s"
+}
+
+// Whether the char is part of the match waiting for confirmation
+func substitute_highlight(b *buffer, l, c int) bool {
+	s := current_substitution
+	return s != nil && s.b == b && s.match_line == l && c >= s.match_beg && c < s.match_end
+}
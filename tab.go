@@ -0,0 +1,148 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+)
+
+// Tab pages each hold their own window layout, root_view_tree and
+// current_view_tree are the ones of the current tab and are saved back in it
+// when switching to another. Buffers are shared by every tab.
+
+type tab_page struct {
+	root    *view_tree
+	current *view_tree
+	zoomed  bool
+}
+
+var (
+	tabs        = []*tab_page{}
+	current_tab = 0
+)
+
+func init_tabs() {
+	bind("normal", k("g t"), func(vt *view_tree, b *buffer, kl *key_list) {
+		if kl.count > 0 {
+			tab_activate(kl.count - 1)
+		} else {
+			tab_activate((current_tab + 1) % len(tabs))
+		}
+	})
+	bind("normal", k("g T"), func(vt *view_tree, b *buffer, kl *key_list) {
+		n := len(tabs)
+		tab_activate(((current_tab-kl.times())%n + n) % n)
+	})
+
+	add_command("tabnew", command_tabnew)
+	add_command("tabclose", command_tabclose)
+	add_alias("tabc", "tabclose")
+	add_command("tabnext", func(r *ex_range, args []string) {
+		tab_activate((current_tab + 1) % len(tabs))
+	})
+	add_alias("tabn", "tabnext")
+	add_command("tabprevious", func(r *ex_range, args []string) {
+		tab_activate((current_tab + len(tabs) - 1) % len(tabs))
+	})
+	add_alias("tabp", "tabprevious")
+}
+
+func tab_save() {
+	t := tabs[current_tab]
+	t.root = root_view_tree
+	t.current = current_view_tree
+	t.zoomed = window_zoomed
+}
+
+func tab_activate(i int) {
+	if i < 0 || i >= len(tabs) {
+		message_error("No tab " + strconv.Itoa(i+1))
+		return
+	}
+	tab_save()
+	current_tab = i
+	t := tabs[i]
+	root_view_tree = t.root
+	current_view_tree = t.current
+	window_zoomed = t.zoomed
+}
+
+// Runs f with each tab activated in turn
+func tab_each(f func()) {
+	active := current_tab
+	for i := range tabs {
+		tab_activate(i)
+		f()
+	}
+	tab_activate(active)
+}
+
+// Opens a new tab after the current one, editing the file at path or
+// showing the current buffer
+func command_tabnew(r *ex_range, args []string) {
+	b := current_view_tree.leaf.buf
+	if len(args) > 1 {
+		path, err := filepath.Abs(args[1])
+		if err != nil {
+			path = args[1]
+		}
+		if b = open_buffer_from_file(path); b == nil {
+			return
+		}
+	}
+	tab_save()
+	vt := new_view_tree_leaf(nil, new_view(b))
+	t := &tab_page{root: vt, current: vt}
+	tabs = append(tabs[:current_tab+1], append([]*tab_page{t}, tabs[current_tab+1:]...)...)
+	tab_activate(current_tab + 1)
+}
+
+func command_tabclose(r *ex_range, args []string) {
+	if len(tabs) == 1 {
+		message_error("Can't close last tab")
+		return
+	}
+	tabs = append(tabs[:current_tab], tabs[current_tab+1:]...)
+	current_tab = min(current_tab, len(tabs)-1)
+	t := tabs[current_tab]
+	root_view_tree = t.root
+	current_view_tree = t.current
+	window_zoomed = t.zoomed
+}
+
+// Labels of the tabs for the tab line, the name of the buffer in their
+// current window
+func tab_labels() []string {
+	labels := []string{}
+	for i, t := range tabs {
+		current := t.current
+		if i == current_tab {
+			current = current_view_tree
+		}
+		b := current.leaf.buf
+		label := " " + strconv.Itoa(i+1) + " " + b.name
+		if b.modified {
+			label += " [+]"
+		}
+		labels = append(labels, label+" ")
+	}
+	return labels
+}
+
+// Views of every window in every tab, including the alternate views they
+// can go back to
+func all_views() []*view {
+	views := []*view{}
+	for i, t := range tabs {
+		root := t.root
+		if i == current_tab {
+			root = root_view_tree
+		}
+		for _, vt := range root.leaves() {
+			views = append(views, vt.leaf)
+			if vt.alternate != nil {
+				views = append(views, vt.alternate)
+			}
+		}
+	}
+	return views
+}
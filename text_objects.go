@@ -0,0 +1,356 @@
+package main
+
+// Text objects select a span of text around the cursor (i w, a (, i p...),
+// they can be the target of an operator or extend the visual selection.
+// They return nil when no such object is found around the cursor.
+
+type text_object_fn func(b *buffer, count int) (r *char_range, linewise bool)
+
+func init_text_objects() {
+	bind_text_object("i w", text_object_word(false, false))
+	bind_text_object("a w", text_object_word(true, false))
+	bind_text_object("i W", text_object_word(false, true))
+	bind_text_object("a W", text_object_word(true, true))
+	for _, q := range []rune{'"', '\'', '`'} {
+		bind_text_object("i "+string(q), text_object_quote(q, false))
+		bind_text_object("a "+string(q), text_object_quote(q, true))
+	}
+	for _, pair := range []string{"()b", "[]", "{}B", "<>"} {
+		open, close := rune(pair[0]), rune(pair[1])
+		for _, name := range pair {
+			bind_text_object("i "+string(name), text_object_pair(open, close, false))
+			bind_text_object("a "+string(name), text_object_pair(open, close, true))
+		}
+	}
+	bind_text_object("i p", text_object_paragraph(false))
+	bind_text_object("a p", text_object_paragraph(true))
+	bind_text_object("i t", text_object_tag(false))
+	bind_text_object("a t", text_object_tag(true))
+}
+
+func bind_text_object(keys string, f text_object_fn) {
+	bind("operator-pending", k(keys), func(vt *view_tree, b *buffer, kl *key_list) {
+		r, linewise := f(b, operator_count_keys(kl).times())
+		if r == nil {
+			operator_cancel(vt, b, kl)
+			return
+		}
+		operator_apply_range(vt, b, r, linewise)
+	})
+	visual_fn := func(vt *view_tree, b *buffer, kl *key_list) {
+		r, _ := f(b, kl.times())
+		if r == nil || r.end <= r.beg {
+			return
+		}
+		visual_extend(b, r)
+	}
+	bind("visual", k(keys), visual_fn)
+	bind("visual-line", k(keys), visual_fn)
+}
+
+// {{{ words
+const (
+	char_class_space = iota
+	char_class_word
+	char_class_punct
+)
+
+func char_class(r rune, big_word bool) int {
+	if is_space(r) {
+		return char_class_space
+	}
+	if big_word || is_word(r) {
+		return char_class_word
+	}
+	return char_class_punct
+}
+
+func text_object_word(around, big_word bool) text_object_fn {
+	return func(b *buffer, count int) (*char_range, bool) {
+		line := b.get_line(b.cursor.line)
+		if len(line) == 0 {
+			return nil, false
+		}
+		class := func(c int) int {
+			return char_class(line[c], big_word)
+		}
+		// End of the run of chars of the same class starting at c
+		run_end := func(c int) int {
+			cls := class(c)
+			for c < len(line) && class(c) == cls {
+				c++
+			}
+			return c
+		}
+
+		c := min(b.cursor.char, len(line)-1)
+		beg := c
+		for beg > 0 && class(beg-1) == class(c) {
+			beg--
+		}
+		end := beg
+		on_space := class(c) == char_class_space
+		for i := 0; i < count && end < len(line); i++ {
+			end = run_end(end)
+			if around && end < len(line) && (on_space || class(end) == char_class_space) {
+				// a w also takes the white space after the word, or the
+				// word after the white space
+				end = run_end(end)
+			}
+		}
+		if around && !on_space && (end == len(line) || class(end-1) != char_class_space) {
+			// No white space after the word, take the one before it
+			for beg > 0 && class(beg-1) == char_class_space {
+				beg--
+			}
+		}
+		offset := b.text.line_start(b.cursor.line)
+		return new_char_range(offset+beg, offset+end), false
+	}
+}
+
+// }}}
+
+// {{{ quotes
+func text_object_quote(q rune, around bool) text_object_fn {
+	return func(b *buffer, count int) (*char_range, bool) {
+		line := b.get_line(b.cursor.line)
+		quotes := []int{}
+		for i, ch := range line {
+			if ch == q && (i == 0 || line[i-1] != '\\') {
+				quotes = append(quotes, i)
+			}
+		}
+		// Quotes are paired from the start of the line, use the pair the
+		// cursor is in or the first one after it
+		beg, end := -1, -1
+		for i := 0; i+1 < len(quotes); i += 2 {
+			if quotes[i+1] >= b.cursor.char {
+				beg, end = quotes[i], quotes[i+1]
+				break
+			}
+		}
+		if beg == -1 {
+			return nil, false
+		}
+		if around {
+			end++
+			if end < len(line) && is_space(line[end]) {
+				for end < len(line) && is_space(line[end]) {
+					end++
+				}
+			} else {
+				for beg > 0 && is_space(line[beg-1]) {
+					beg--
+				}
+			}
+		} else {
+			beg++
+		}
+		offset := b.text.line_start(b.cursor.line)
+		return new_char_range(offset+beg, offset+end), false
+	}
+}
+
+// }}}
+
+// {{{ pairs
+func text_object_pair(open, close rune, around bool) text_object_fn {
+	return func(b *buffer, count int) (*char_range, bool) {
+		t := b.text
+		pos := b.offset(b.cursor)
+		beg, end := -1, -1
+		for i := 0; i < count; i++ {
+			beg = find_unmatched_backward(t, pos, open, close)
+			if beg == -1 {
+				return nil, false
+			}
+			end = find_unmatched_forward(t, beg+1, open, close)
+			if end == -1 {
+				return nil, false
+			}
+			pos = beg - 1
+		}
+		if around {
+			return new_char_range(beg, end+1), false
+		}
+
+		// When the pair is on it's own lines, only take the lines in between
+		open_line, open_char := t.location(beg)
+		close_line, close_char := t.location(end)
+		if close_line > open_line+1 &&
+			open_char+1 == len(b.get_line(open_line)) &&
+			is_blank(b.get_line(close_line)[:close_char]) {
+			return b.line_range(open_line+1, close_line-1), true
+		}
+		return new_char_range(beg+1, end), false
+	}
+}
+
+// Offset of the open char enclosing pos (pos itself if it is one)
+func find_unmatched_backward(t *text_store, pos int, open, close rune) int {
+	if pos >= 0 && pos < t.length() && t.rune_at(pos) == close {
+		pos--
+	}
+	depth := 0
+	for ; pos >= 0; pos-- {
+		switch t.rune_at(pos) {
+		case close:
+			depth++
+		case open:
+			if depth == 0 {
+				return pos
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// Offset of the close char matching an open char right before pos
+func find_unmatched_forward(t *text_store, pos int, open, close rune) int {
+	depth := 0
+	for length := t.length(); pos < length; pos++ {
+		switch t.rune_at(pos) {
+		case open:
+			depth++
+		case close:
+			if depth == 0 {
+				return pos
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// }}}
+
+// {{{ paragraphs
+func text_object_paragraph(around bool) text_object_fn {
+	return func(b *buffer, count int) (*char_range, bool) {
+		line_count := b.line_count()
+		blank := func(l int) bool {
+			return is_blank(b.get_line(l))
+		}
+		// Last line of the block of blank or non blank lines starting at l
+		block_end := func(l int) int {
+			kind := blank(l)
+			for l+1 < line_count && blank(l+1) == kind {
+				l++
+			}
+			return l
+		}
+
+		l1 := b.cursor.line
+		for l1 > 0 && blank(l1-1) == blank(b.cursor.line) {
+			l1--
+		}
+		l2 := l1 - 1
+		for i := 0; i < count && l2+1 < line_count; i++ {
+			l2 = block_end(l2 + 1)
+			if around && l2+1 < line_count {
+				l2 = block_end(l2 + 1)
+			}
+		}
+		if around && !blank(l1) && !blank(l2) {
+			// No blank lines after the paragraph, take the ones before
+			for l1 > 0 && blank(l1-1) {
+				l1--
+			}
+		}
+		return b.line_range(l1, l2), true
+	}
+}
+
+// }}}
+
+// {{{ tags
+type text_object_tag_pos struct {
+	name    string
+	closing bool
+	beg     int
+	end     int
+}
+
+func text_object_tag(around bool) text_object_fn {
+	return func(b *buffer, count int) (*char_range, bool) {
+		text := b.text.slice(0, b.text.length())
+		pos := b.offset(b.cursor)
+
+		// Match open and close tags, keeping the pairs enclosing the cursor
+		enclosing := [][2]*text_object_tag_pos{}
+		stack := []*text_object_tag_pos{}
+		for _, tag := range parse_tags(text) {
+			if !tag.closing {
+				stack = append(stack, tag)
+				continue
+			}
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].name == tag.name {
+					if stack[i].beg <= pos && pos < tag.end {
+						enclosing = append(enclosing, [2]*text_object_tag_pos{stack[i], tag})
+					}
+					stack = stack[:i]
+					break
+				}
+			}
+		}
+		// Pairs are found innermost first
+		if count > len(enclosing) {
+			return nil, false
+		}
+		pair := enclosing[count-1]
+		if around {
+			return new_char_range(pair[0].beg, pair[1].end), false
+		}
+		return new_char_range(pair[0].end, pair[1].beg), false
+	}
+}
+
+// Finds opening and closing tags, self closing tags are skipped
+func parse_tags(text []rune) []*text_object_tag_pos {
+	tags := []*text_object_tag_pos{}
+	for i := 0; i < len(text); i++ {
+		if text[i] != '<' {
+			continue
+		}
+		tag := &text_object_tag_pos{beg: i}
+		j := i + 1
+		if j < len(text) && text[j] == '/' {
+			tag.closing = true
+			j++
+		}
+		name_beg := j
+		for j < len(text) && (is_word(text[j]) || text[j] == '-' || text[j] == ':' || text[j] == '.') {
+			j++
+		}
+		if j == name_beg {
+			continue
+		}
+		tag.name = string(text[name_beg:j])
+		for j < len(text) && text[j] != '>' && text[j] != '<' {
+			j++
+		}
+		if j == len(text) || text[j] != '>' {
+			continue
+		}
+		tag.end = j + 1
+		if text[j-1] != '/' {
+			tags = append(tags, tag)
+		}
+		i = j
+	}
+	return tags
+}
+
+// }}}
+
+func is_blank(line []rune) bool {
+	for _, ch := range line {
+		if !is_space(ch) {
+			return false
+		}
+	}
+	return true
+}
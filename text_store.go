@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+)
+
+// Piece table backing a buffer's contents. The text never contains the
+// trailing newline that files end with, lines are separated by '\n' so an
+// empty store is a single empty line.
+//
+// Runes are never moved once written: the original file lives in `orig` and
+// everything typed afterwards is appended to `add`. The sorted offsets of
+// the newlines in both are kept so that line lookups are binary searches
+// instead of scans.
+type piece struct {
+	add      bool
+	start    int
+	length   int
+	newlines int
+}
+
+type text_store struct {
+	orig    []rune
+	add     []rune
+	orig_nl []int
+	add_nl  []int
+	pieces  []*piece
+
+	// piece_offsets[i] and piece_lines[i] are the number of runes and
+	// newlines before piece i (both have an extra last element holding the
+	// totals), edits only update the entries after the pieces they touch
+	piece_offsets []int
+	piece_lines   []int
+
+	// Last line returned by line(), cleared on every edit
+	cached_line_index int
+	cached_line       []rune
+}
+
+func new_text_store(data []rune) *text_store {
+	t := &text_store{
+		orig:              data,
+		add:               []rune{},
+		orig_nl:           newline_offsets(data, 0),
+		add_nl:            []int{},
+		pieces:            []*piece{},
+		piece_offsets:     []int{0},
+		piece_lines:       []int{0},
+		cached_line_index: -1,
+	}
+	if len(data) > 0 {
+		t.insert_piece(0, t.new_piece(false, 0, len(data)))
+	}
+	return t
+}
+
+func newline_offsets(data []rune, base int) []int {
+	offsets := []int{}
+	for i, r := range data {
+		if r == '\n' {
+			offsets = append(offsets, base+i)
+		}
+	}
+	return offsets
+}
+
+func (t *text_store) piece_data(p *piece) []rune {
+	if p.add {
+		return t.add[p.start : p.start+p.length]
+	}
+	return t.orig[p.start : p.start+p.length]
+}
+
+// Index (in orig_nl or add_nl) of the first newline inside p
+func (t *text_store) piece_first_newline(p *piece) (int, []int) {
+	nl := t.orig_nl
+	if p.add {
+		nl = t.add_nl
+	}
+	return sort.SearchInts(nl, p.start), nl
+}
+
+func (t *text_store) piece_newlines(p *piece) int {
+	i, nl := t.piece_first_newline(p)
+	return sort.SearchInts(nl, p.start+p.length) - i
+}
+
+func (t *text_store) new_piece(add bool, start, length int) *piece {
+	p := &piece{add: add, start: start, length: length}
+	p.newlines = t.piece_newlines(p)
+	return p
+}
+
+func (t *text_store) edited() {
+	t.cached_line_index = -1
+	t.cached_line = nil
+}
+
+// Adds runes and newlines to the index entries from piece i on
+func (t *text_store) shift_index(i, runes, newlines int) {
+	for ; i <= len(t.pieces); i++ {
+		t.piece_offsets[i] += runes
+		t.piece_lines[i] += newlines
+	}
+}
+
+// Inserts p before piece i
+func (t *text_store) insert_piece(i int, p *piece) {
+	t.pieces = append(t.pieces, nil)
+	copy(t.pieces[i+1:], t.pieces[i:])
+	t.pieces[i] = p
+	t.piece_offsets = append(t.piece_offsets, 0)
+	copy(t.piece_offsets[i+1:], t.piece_offsets[i:])
+	t.piece_lines = append(t.piece_lines, 0)
+	copy(t.piece_lines[i+1:], t.piece_lines[i:])
+	t.shift_index(i+1, p.length, p.newlines)
+}
+
+func (t *text_store) length() int {
+	return t.piece_offsets[len(t.pieces)]
+}
+
+func (t *text_store) line_count() int {
+	return t.piece_lines[len(t.pieces)] + 1
+}
+
+// Rune offset of the first char of line l
+func (t *text_store) line_start(l int) int {
+	if l <= 0 {
+		return 0
+	}
+	if l >= t.line_count() {
+		return t.length()
+	}
+	// First piece where the l-th newline is found
+	i := sort.Search(len(t.pieces), func(i int) bool {
+		return t.piece_lines[i+1] >= l
+	})
+	p := t.pieces[i]
+	first, nl := t.piece_first_newline(p)
+	nl_offset := nl[first+l-t.piece_lines[i]-1]
+	return t.piece_offsets[i] + nl_offset - p.start + 1
+}
+
+func (t *text_store) line_end(l int) int {
+	if l+1 >= t.line_count() {
+		return t.length()
+	}
+	return t.line_start(l+1) - 1
+}
+
+// Returns line l without it's newline, the returned slice is shared and must
+// not be modified
+func (t *text_store) line(l int) []rune {
+	if l == t.cached_line_index {
+		return t.cached_line
+	}
+	t.cached_line = t.slice(t.line_start(l), t.line_end(l))
+	t.cached_line_index = l
+	return t.cached_line
+}
+
+// Rune offset of the given position, chars past the end of a line point to
+// it's newline
+func (t *text_store) offset(l, c int) int {
+	start := t.line_start(l)
+	return start + max(min(c, t.line_end(l)-start), 0)
+}
+
+// Line and char of the given rune offset
+func (t *text_store) location(offset int) (int, int) {
+	offset = max(min(offset, t.length()), 0)
+	i := t.find_piece(offset)
+	l := 0
+	if i < len(t.pieces) {
+		p := t.pieces[i]
+		first, nl := t.piece_first_newline(p)
+		in_piece := sort.SearchInts(nl, p.start+offset-t.piece_offsets[i]) - first
+		l = t.piece_lines[i] + in_piece
+	} else {
+		l = t.piece_lines[len(t.pieces)]
+	}
+	return l, offset - t.line_start(l)
+}
+
+// Index of the piece containing offset (len(pieces) for the end of the text)
+func (t *text_store) find_piece(offset int) int {
+	return sort.Search(len(t.pieces), func(i int) bool {
+		return t.piece_offsets[i+1] > offset
+	})
+}
+
+// Rune at offset, '\n' past the end of the text
+func (t *text_store) rune_at(offset int) rune {
+	i := t.find_piece(offset)
+	if offset < 0 || i == len(t.pieces) {
+		return '\n'
+	}
+	return t.piece_data(t.pieces[i])[offset-t.piece_offsets[i]]
+}
+
+func (t *text_store) slice(beg, end int) []rune {
+	end = min(end, t.length())
+	if beg >= end {
+		return []rune{}
+	}
+	data := make([]rune, 0, end-beg)
+	for i := t.find_piece(beg); i < len(t.pieces) && t.piece_offsets[i] < end; i++ {
+		pd := t.piece_data(t.pieces[i])
+		from := max(beg-t.piece_offsets[i], 0)
+		to := min(end-t.piece_offsets[i], len(pd))
+		data = append(data, pd[from:to]...)
+	}
+	return data
+}
+
+// Splits the piece containing offset so that a piece starts exactly at
+// offset and returns that piece's index
+func (t *text_store) split(offset int) int {
+	i := t.find_piece(offset)
+	if i == len(t.pieces) || t.piece_offsets[i] == offset {
+		return i
+	}
+	p := t.pieces[i]
+	left := offset - t.piece_offsets[i]
+	right := t.new_piece(p.add, p.start+left, p.length-left)
+	p.length = left
+	p.newlines -= right.newlines
+	// The text doesn't change, the right part takes the place it had in
+	// the index
+	t.shift_index(i+1, -right.length, -right.newlines)
+	t.insert_piece(i+1, right)
+	return i + 1
+}
+
+func (t *text_store) insert(offset int, data []rune) {
+	if len(data) == 0 {
+		return
+	}
+	offset = max(min(offset, t.length()), 0)
+	start := len(t.add)
+	t.add = append(t.add, data...)
+	data_nl := newline_offsets(data, start)
+	t.add_nl = append(t.add_nl, data_nl...)
+
+	i := t.split(offset)
+	t.edited()
+	// Typing appends to the add buffer right after the previous insert, grow
+	// that piece instead of creating a new one every keystroke
+	if i > 0 {
+		prev := t.pieces[i-1]
+		if prev.add && prev.start+prev.length == start {
+			prev.length += len(data)
+			prev.newlines += len(data_nl)
+			t.shift_index(i, len(data), len(data_nl))
+			return
+		}
+	}
+	t.insert_piece(i, &piece{add: true, start: start, length: len(data), newlines: len(data_nl)})
+}
+
+// Removes up to n runes at offset, returning the removed runes
+func (t *text_store) remove(offset, n int) []rune {
+	offset = max(min(offset, t.length()), 0)
+	end := min(offset+n, t.length())
+	if offset >= end {
+		return []rune{}
+	}
+	removed := t.slice(offset, end)
+	i := t.split(offset)
+	j := t.split(end)
+	lines := t.piece_lines[j] - t.piece_lines[i]
+	t.pieces = append(t.pieces[:i], t.pieces[j:]...)
+	t.piece_offsets = append(t.piece_offsets[:i], t.piece_offsets[j:]...)
+	t.piece_lines = append(t.piece_lines[:i], t.piece_lines[j:]...)
+	t.shift_index(i, -(end - offset), -lines)
+	t.edited()
+	return removed
+}
+
+func (t *text_store) write_to(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, p := range t.pieces {
+		for _, r := range t.piece_data(p) {
+			if _, err := bw.WriteRune(r); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func (t *text_store) String() string {
+	var buf bytes.Buffer
+	t.write_to(&buf)
+	return buf.String()
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Undo history is kept as a tree: making a change after undoing starts a new
+// branch instead of dropping the undone changes. Nodes are numbered in the
+// order they were created so that g- and g+ can walk through every state the
+// buffer was in, whichever branch it is on.
+//
+// Each node is a change group, all the actions made between
+// begin_change_group and end_change_group (a whole insert session, a whole
+// operator) are undone and redone together.
+
+type undo_node struct {
+	seq      int
+	parent   *undo_node
+	children []*undo_node
+	// Child redo follows, the last one created or undone from
+	redo_child *undo_node
+	actions    []*action
+	time       time.Time
+}
+
+type undo_tree struct {
+	root    *undo_node
+	current *undo_node
+	// Live nodes ordered by seq
+	nodes    []*undo_node
+	last_seq int
+
+	group_depth int
+	// Node actions are added to while a group is open
+	group_node *undo_node
+}
+
+func new_undo_tree() *undo_tree {
+	root := &undo_node{seq: 0, children: []*undo_node{}, time: time.Now()}
+	return &undo_tree{root: root, current: root, nodes: []*undo_node{root}}
+}
+
+func init_undo() {
+	bind("normal", k("g -"), command_undo_older)
+	bind("normal", k("g +"), command_undo_newer)
+
+	add_command("undolist", command_undolist)
+	add_alias("undol", "undolist")
+
+	add_mode("undolist")
+	bind("undolist", k("q"), func(vt *view_tree, b *buffer, kl *key_list) {
+		close_current_buffer(true)
+	})
+	bind("undolist", k("RET"), func(vt *view_tree, b *buffer, kl *key_list) {
+		fields := strings.Fields(strings.TrimLeft(string(b.get_line(b.cursor.line)), ">"))
+		if len(fields) == 0 {
+			return
+		}
+		seq, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return
+		}
+		target := show_buffer(undolist_buffer_name)
+		close_buffer(b)
+		if target != nil {
+			target.history.go_to(target, seq)
+		}
+	})
+}
+
+// Records an action already applied to the buffer, as a new state or as part
+// of the open change group
+func (t *undo_tree) add(b *buffer, a *action) {
+	if t.group_depth > 0 && t.group_node == t.current && t.current != t.root {
+		n := t.group_node
+		if !try_merge_history(n.actions[len(n.actions)-1], a) {
+			n.actions = append(n.actions, a)
+		}
+		return
+	}
+
+	t.last_seq++
+	n := &undo_node{
+		seq:      t.last_seq,
+		parent:   t.current,
+		children: []*undo_node{},
+		actions:  []*action{a},
+		time:     time.Now(),
+	}
+	t.current.children = append(t.current.children, n)
+	t.current.redo_child = n
+	t.current = n
+	t.nodes = append(t.nodes, n)
+	if t.group_depth > 0 {
+		t.group_node = n
+	}
+	t.prune(int(config_get_number("undo_levels", b)))
+}
+
+func (t *undo_tree) begin_group() {
+	if t.group_depth == 0 {
+		t.group_node = nil
+	}
+	t.group_depth++
+}
+
+func (t *undo_tree) end_group() {
+	if t.group_depth > 0 {
+		t.group_depth--
+	}
+	if t.group_depth == 0 {
+		t.group_node = nil
+	}
+}
+
+// Drops the oldest changes until at most levels are kept. Old states on the
+// current branch are folded into the root, others are dropped with their
+// whole branch.
+func (t *undo_tree) prune(levels int) {
+	if levels <= 0 || len(t.nodes)-1 <= levels {
+		return
+	}
+	on_path := t.path_to(t.current)
+	for len(t.nodes)-1 > levels {
+		oldest := t.nodes[1]
+		if on_path[oldest] {
+			oldest.parent = nil
+			oldest.actions = nil
+			t.root = oldest
+		} else {
+			p := oldest.parent
+			for i, c := range p.children {
+				if c == oldest {
+					p.children = append(p.children[:i], p.children[i+1:]...)
+					break
+				}
+			}
+			if p.redo_child == oldest {
+				p.redo_child = nil
+			}
+		}
+		t.nodes = t.live_nodes()
+	}
+}
+
+// Nodes reachable from the root, ordered by seq
+func (t *undo_tree) live_nodes() []*undo_node {
+	nodes := []*undo_node{}
+	stack := []*undo_node{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		nodes = append(nodes, n)
+		stack = append(stack, n.children...)
+	}
+	sort.Sort(undo_nodes_by_seq(nodes))
+	return nodes
+}
+
+type undo_nodes_by_seq []*undo_node
+
+func (ns undo_nodes_by_seq) Len() int           { return len(ns) }
+func (ns undo_nodes_by_seq) Swap(i, j int)      { ns[i], ns[j] = ns[j], ns[i] }
+func (ns undo_nodes_by_seq) Less(i, j int) bool { return ns[i].seq < ns[j].seq }
+
+// Index in t.nodes of the node numbered seq, -1 if it was dropped
+func (t *undo_tree) find(seq int) int {
+	i := sort.Search(len(t.nodes), func(i int) bool {
+		return t.nodes[i].seq >= seq
+	})
+	if i < len(t.nodes) && t.nodes[i].seq == seq {
+		return i
+	}
+	return -1
+}
+
+func (t *undo_tree) path_to(target *undo_node) map[*undo_node]bool {
+	on_path := map[*undo_node]bool{}
+	for n := target; n != nil; n = n.parent {
+		on_path[n] = true
+	}
+	return on_path
+}
+
+func (t *undo_tree) undo(b *buffer) bool {
+	if t.current == t.root {
+		return false
+	}
+	n := t.current
+	for i := len(n.actions) - 1; i >= 0; i-- {
+		n.actions[i].revert(b)
+	}
+	n.parent.redo_child = n
+	t.current = n.parent
+	b.move_to(n.actions[0].loc.char, n.actions[0].loc.line)
+	return true
+}
+
+func (t *undo_tree) redo(b *buffer) bool {
+	n := t.current.redo_child
+	if n == nil {
+		return false
+	}
+	for _, a := range n.actions {
+		a.apply(b)
+	}
+	t.current = n
+	b.move_to(n.actions[0].loc.char, n.actions[0].loc.line)
+	return true
+}
+
+// Moves the buffer to the state after change seq, undoing up to the common
+// ancestor then redoing down the target's branch
+func (t *undo_tree) go_to(b *buffer, seq int) bool {
+	i := t.find(seq)
+	if i == -1 {
+		return false
+	}
+	target := t.nodes[i]
+
+	// Path from the root to the target
+	path := []*undo_node{}
+	for n := target; n != nil; n = n.parent {
+		path = append([]*undo_node{n}, path...)
+	}
+	on_path := t.path_to(target)
+
+	for !on_path[t.current] {
+		t.undo(b)
+	}
+	for i, n := range path {
+		if n == t.current && i+1 < len(path) {
+			n.redo_child = path[i+1]
+			t.redo(b)
+		}
+	}
+	return true
+}
+
+// Changes made until the matching end_change_group are undone as one step,
+// groups can be nested
+func (b *buffer) begin_change_group() {
+	b.history.begin_group()
+}
+
+func (b *buffer) end_change_group() {
+	b.history.end_group()
+}
+
+func (b *buffer) undo() {
+	if !b.history.undo(b) {
+		message("Noting to undo!")
+	}
+}
+
+func (b *buffer) redo() {
+	if !b.history.redo(b) {
+		message("Noting to redo!")
+	}
+}
+
+func command_undo_older(vt *view_tree, b *buffer, kl *key_list) {
+	t := b.history
+	i := t.find(t.current.seq)
+	if i == 0 {
+		message("Already at oldest change")
+		return
+	}
+	t.go_to(b, t.nodes[max(i-kl.times(), 0)].seq)
+}
+
+func command_undo_newer(vt *view_tree, b *buffer, kl *key_list) {
+	t := b.history
+	i := t.find(t.current.seq)
+	if i == len(t.nodes)-1 {
+		message("Already at newest change")
+		return
+	}
+	t.go_to(b, t.nodes[min(i+kl.times(), len(t.nodes)-1)].seq)
+}
+
+// Name of the buffer the *undolist* buffer was last opened for
+var undolist_buffer_name = ""
+
+// Lists the leaves of the current buffer's undo tree, one per branch
+func command_undolist(r *ex_range, args []string) {
+	target := current_view_tree.leaf.buf
+	if target.name == "*undolist*" {
+		return
+	}
+	t := target.history
+
+	lines := []string{"  number changes  time"}
+	for _, n := range t.nodes {
+		if len(n.children) > 0 || n == t.root {
+			continue
+		}
+		changes := 0
+		for p := n; p != t.root; p = p.parent {
+			changes++
+		}
+		prefix := " "
+		if n == t.current {
+			prefix = ">"
+		}
+		lines = append(lines, fmt.Sprintf("%s%6d %7d  %s",
+			prefix, n.seq, changes, n.time.Format("15:04:05")))
+	}
+	if len(lines) == 1 {
+		message("Nothing to undo")
+		return
+	}
+
+	var b *buffer
+	if b = find_buffer("*undolist*"); b == nil {
+		b = open_buffer_named("*undolist*")
+		b.add_mode("undolist")
+	}
+	undolist_buffer_name = target.name
+	b.set_contents(strings.Join(lines, "\n"))
+	hook_trigger_buffer("modified", b)
+	show_buffer(b.name)
+	b.move_to(0, len(lines)-1)
+}
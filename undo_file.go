@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Undo trees are persisted in ~/.ry/undo, one JSON file per path named after
+// it's hash. The file keeps a hash of the text the history leads to so that
+// history for a file changed by something else since is ignored. Loaded
+// trees are pruned to undo_levels like the ones being edited.
+
+type undo_file struct {
+	Hash    string
+	Current int
+	LastSeq int
+	Nodes   []*undo_file_node
+}
+
+type undo_file_node struct {
+	Seq       int
+	Parent    int
+	RedoChild int
+	Time      time.Time
+	Actions   []*undo_file_action
+}
+
+type undo_file_action struct {
+	Type int
+	Line int
+	Char int
+	Data string
+}
+
+func undo_file_path(b *buffer) string {
+	return filepath.Join(os.Getenv("HOME"), ".ry", "undo", undo_hash(b.path)+".json")
+}
+
+func undo_file_hash(b *buffer) string {
+	return undo_hash(b.contents())
+}
+
+func undo_hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Saves the buffer's undo tree, only done when the buffer matches what is on
+// disk so that the hash can be checked when reopening it
+func undo_file_write(b *buffer) {
+	if !config_get_bool("undo_file", b) || b.path == "" || b.modified ||
+		len(b.history.root.children) == 0 {
+		return
+	}
+
+	t := b.history
+	uf := &undo_file{
+		Hash:    undo_file_hash(b),
+		Current: t.current.seq,
+		LastSeq: t.last_seq,
+		Nodes:   []*undo_file_node{},
+	}
+	for _, n := range t.nodes {
+		ufn := &undo_file_node{Seq: n.seq, Parent: -1, RedoChild: -1, Time: n.time}
+		if n.parent != nil {
+			ufn.Parent = n.parent.seq
+		}
+		if n.redo_child != nil {
+			ufn.RedoChild = n.redo_child.seq
+		}
+		for _, a := range n.actions {
+			ufn.Actions = append(ufn.Actions, &undo_file_action{
+				Type: int(a.typ),
+				Line: a.loc.line,
+				Char: a.loc.char,
+				Data: string(a.data),
+			})
+		}
+		uf.Nodes = append(uf.Nodes, ufn)
+	}
+
+	data, err := json.Marshal(uf)
+	if err == nil {
+		path := undo_file_path(b)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = ioutil.WriteFile(path, data, 0644)
+		}
+	}
+	if err != nil {
+		message_error("Error writing undo file: " + err.Error())
+	}
+}
+
+// Restores the undo tree saved for the buffer's path, if it's text didn't
+// change since
+func undo_file_read(b *buffer) {
+	if !config_get_bool("undo_file", b) || b.path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(undo_file_path(b))
+	if err != nil {
+		return
+	}
+	uf := &undo_file{}
+	if err := json.Unmarshal(data, uf); err != nil {
+		message_error("Error reading undo file: " + err.Error())
+		return
+	}
+	if uf.Hash != undo_file_hash(b) || len(uf.Nodes) == 0 {
+		return
+	}
+
+	t := &undo_tree{nodes: []*undo_node{}, last_seq: uf.LastSeq}
+	by_seq := map[int]*undo_node{}
+	for _, ufn := range uf.Nodes {
+		n := &undo_node{seq: ufn.Seq, children: []*undo_node{}, time: ufn.Time}
+		for _, ufa := range ufn.Actions {
+			loc := new_location(ufa.Line, ufa.Char)
+			a := new_action(action_type(ufa.Type), loc, []rune(ufa.Data))
+			a.end = location_after(loc, a.data)
+			n.actions = append(n.actions, a)
+		}
+		if p, ok := by_seq[ufn.Parent]; ok {
+			n.parent = p
+			p.children = append(p.children, n)
+		} else if t.root == nil {
+			t.root = n
+		} else {
+			return
+		}
+		by_seq[n.seq] = n
+		t.nodes = append(t.nodes, n)
+	}
+	for _, ufn := range uf.Nodes {
+		by_seq[ufn.Seq].redo_child = by_seq[ufn.RedoChild]
+	}
+	if t.current = by_seq[uf.Current]; t.current == nil {
+		return
+	}
+	t.prune(int(config_get_number("undo_levels", b)))
+	b.history = t
+}
@@ -7,6 +7,8 @@ func init_visual() {
 	bind("visual", k("d"), visual_mode_delete)
 	bind("visual", k("p"), visual_mode_paste)
 	bind("visual", k("c"), visual_mode_change)
+	bind("visual", k(":"), visual_mode_command)
+	bind("visual", k("\" $any"), command_select_register)
 
 	add_mode("visual-line")
 	bind("visual-line", k("ESC"), exit_visual_mode)
@@ -14,6 +16,8 @@ func init_visual() {
 	bind("visual-line", k("d"), visual_mode_delete)
 	bind("visual-line", k("p"), visual_mode_paste)
 	bind("visual-line", k("c"), visual_mode_change)
+	bind("visual-line", k(":"), visual_mode_command)
+	bind("visual-line", k("\" $any"), command_select_register)
 
 	hook_buffer("moved", visual_rehighlight)
 }
@@ -87,33 +91,52 @@ func visual_mode_selection(b *buffer) ([]rune, *location, *location) {
 	return data, l1, l2
 }
 
+// Grows the selection so that it includes r
+func visual_extend(b *buffer, r *char_range) {
+	m := get_mark('∫')
+	l1, l2 := order_locations(b.cursor, m.loc)
+	beg := min(b.offset(l1), r.beg)
+	end := max(b.offset(l2)+1, r.end)
+
+	l, c := b.text.location(beg)
+	m.loc = new_location(l, c)
+	l, c = b.text.location(end - 1)
+	b.move_to(c, l)
+}
+
 func visual_mode_yank(vt *view_tree, b *buffer, kl *key_list) {
 	text, l1, _ := visual_mode_selection(b)
-	clipboard_set(default_clipboard, text)
+	register_yank(text)
 
 	b.move_to(l1.char, l1.line)
 	exit_visual_mode(vt, b, kl)
 }
 func visual_mode_delete(vt *view_tree, b *buffer, kl *key_list) {
 	text, l1, _ := visual_mode_selection(b)
+	register_delete(text)
 	b.move_to(l1.char, l1.line)
 	b.remove(len(text))
 
 	exit_visual_mode(vt, b, kl)
 }
 func visual_mode_paste(vt *view_tree, b *buffer, kl *key_list) {
+	b.begin_change_group()
+	defer b.end_change_group()
 	text, l1, _ := visual_mode_selection(b)
-	clipboard_text := clipboard_get(default_clipboard)
+	clipboard_text := clipboard_get(register_take())
 	b.move_to(l1.char, l1.line)
 	b.remove(len(text))
 	b.insert(clipboard_text)
-	clipboard_set(default_clipboard, text)
+	register_delete(text)
 
 	b.move_to(l1.char, l1.line)
 	exit_visual_mode(vt, b, kl)
 }
 func visual_mode_change(vt *view_tree, b *buffer, kl *key_list) {
+	b.begin_change_group()
+	defer b.end_change_group()
 	text, l1, _ := visual_mode_selection(b)
+	register_delete(text)
 	b.move_to(l1.char, l1.line)
 	b.remove(len(text))
 
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// Windows are the leaves of the view tree, splitting one replaces it by a
+// node holding the old window and a new one. Closing one replaces it's parent
+// by it's sibling.
+
+// Zoomed, the current window is rendered over the whole screen
+var window_zoomed = false
+
+func init_windows() {
+	bind("normal", k("C-w s"), func(vt *view_tree, b *buffer, kl *key_list) {
+		window_split(false, "")
+	})
+	bind("normal", k("C-w v"), func(vt *view_tree, b *buffer, kl *key_list) {
+		window_split(true, "")
+	})
+	bind("normal", k("C-w h"), window_move_command(-1, 0))
+	bind("normal", k("C-w j"), window_move_command(0, 1))
+	bind("normal", k("C-w k"), window_move_command(0, -1))
+	bind("normal", k("C-w l"), window_move_command(1, 0))
+	bind("normal", k("C-w +"), window_resize_command(false, 1))
+	bind("normal", k("C-w -"), window_resize_command(false, -1))
+	bind("normal", k("C-w >"), window_resize_command(true, 1))
+	bind("normal", k("C-w <"), window_resize_command(true, -1))
+	bind("normal", k("C-w ="), func(vt *view_tree, b *buffer, kl *key_list) {
+		window_equalize(root_view_tree)
+	})
+	bind("normal", k("C-w o"), func(vt *view_tree, b *buffer, kl *key_list) {
+		window_only()
+	})
+	bind("normal", k("C-w c"), func(vt *view_tree, b *buffer, kl *key_list) {
+		window_close(current_view_tree)
+	})
+	bind("normal", k("C-w z"), func(vt *view_tree, b *buffer, kl *key_list) {
+		window_zoomed = !window_zoomed && root_view_tree.leaf == nil
+	})
+	bind("normal", k("C-^"), func(vt *view_tree, b *buffer, kl *key_list) {
+		if alt := vt.alternate_buffer(); alt != nil {
+			vt.show(alt)
+		} else {
+			message_error("No alternate buffer")
+		}
+	})
+
+	add_command("split", command_split(false))
+	add_alias("sp", "split")
+	add_command("vsplit", command_split(true))
+	add_alias("vs", "vsplit")
+	add_command("only", func(r *ex_range, args []string) {
+		window_only()
+	})
+	add_alias("on", "only")
+	add_command("close", func(r *ex_range, args []string) {
+		window_close(current_view_tree)
+	})
+	add_alias("clo", "close")
+}
+
+func command_split(vertical bool) ex_command_fn {
+	return func(r *ex_range, args []string) {
+		path := ""
+		if len(args) > 1 {
+			path = args[1]
+		}
+		window_split(vertical, path)
+	}
+}
+
+// Screen space the windows are rendered in, above the message lines
+func window_area() (int, int, int, int) {
+	h := editor_height - len(message_lines(editor_width))
+	if editor_mode == "prompt" && len(completion_items) > 0 {
+		h--
+	}
+	if len(tabs) > 1 {
+		// Under the tab line
+		return 0, 1, editor_width, h - 1
+	}
+	return 0, 0, editor_width, h
+}
+
+// Splits the current window, showing the file at path in the new one (or the
+// same buffer when path is empty) and moving to it
+func window_split(vertical bool, path string) {
+	v := current_view_tree.leaf
+	b := v.buf
+	if path != "" {
+		if abs_path, err := filepath.Abs(path); err == nil {
+			path = abs_path
+		}
+		if b = open_buffer_from_file(path); b == nil {
+			return
+		}
+	}
+
+	nv := new_view(b)
+	if b == v.buf {
+		nv.line_offset = v.line_offset
+	}
+	window_zoomed = false
+	current_view_tree = current_view_tree.split(nv, vertical)
+}
+
+// Removes a window from the tree, it's sibling takes the space it's parent
+// had
+func window_close(vt *view_tree) {
+	p := vt.parent
+	if p == nil {
+		message_error("Can't close last window")
+		return
+	}
+	sibling := p.left
+	switch vt {
+	case p.left:
+		sibling = p.right
+	case p.top:
+		sibling = p.bottom
+	case p.bottom:
+		sibling = p.top
+	}
+
+	sibling.parent = p.parent
+	sibling.size = p.size
+	if gp := p.parent; gp == nil {
+		root_view_tree = sibling
+	} else {
+		switch p {
+		case gp.left:
+			gp.left = sibling
+		case gp.right:
+			gp.right = sibling
+		case gp.top:
+			gp.top = sibling
+		case gp.bottom:
+			gp.bottom = sibling
+		}
+	}
+
+	if current_view_tree == vt {
+		current_view_tree = sibling.first_leaf()
+	}
+	window_zoomed = false
+}
+
+func window_only() {
+	current_view_tree.parent = nil
+	current_view_tree.size = 50
+	root_view_tree = current_view_tree
+	window_zoomed = false
+}
+
+// Moves to the window next to the current one in the given direction
+func window_move_command(dx, dy int) command_fn {
+	return func(vt *view_tree, b *buffer, kl *key_list) {
+		window_zoomed = false
+		for i := 0; i < kl.times(); i++ {
+			rects := window_rects()
+			r := rects[current_view_tree]
+			// A point just past the current window's border (past the
+			// separator for vertical splits)
+			x, y := r.x, r.y
+			switch {
+			case dx < 0:
+				x = r.x - 2
+			case dx > 0:
+				x = r.x + r.w + 1
+			case dy < 0:
+				y = r.y - 1
+			case dy > 0:
+				y = r.y + r.h
+			}
+			target := window_at(rects, x, y)
+			if target == nil {
+				return
+			}
+			current_view_tree = target
+		}
+	}
+}
+
+// Grows (or shrinks when n is negative) the current window by lines or
+// columns
+func window_resize_command(vertical bool, n int) command_fn {
+	return func(vt *view_tree, b *buffer, kl *key_list) {
+		window_resize(current_view_tree, vertical, n*kl.times())
+	}
+}
+
+func window_resize(vt *view_tree, vertical bool, n int) {
+	// Closest split in the right direction
+	child, p := vt, vt.parent
+	for p != nil && (vertical && p.left == nil || !vertical && p.top == nil) {
+		child, p = p, p.parent
+	}
+	if p == nil {
+		return
+	}
+	rects := window_rects()
+	first, second := p.top, p.bottom
+	if vertical {
+		first, second = p.left, p.right
+	}
+	total, first_cells := rects[p].h, rects[first].h
+	if vertical {
+		total, first_cells = rects[p].w-1, rects[first].w
+	}
+	if child == second {
+		n = -n
+	}
+	if total <= 0 {
+		return
+	}
+	// Sizes are percentages, rounded up so that the first window gets at
+	// least the cells asked for
+	first.size = max(min(((first_cells+n)*100+total-1)/total, 99), 1)
+	second.size = 100 - first.size
+}
+
+// Gives every window the same size, splits are shared in proportion to the
+// number of windows on each side
+func window_equalize(vt *view_tree) {
+	if vt.leaf != nil {
+		return
+	}
+	first, second := vt.top, vt.bottom
+	vertical := vt.left != nil
+	if vertical {
+		first, second = vt.left, vt.right
+	}
+	a, b := first.window_count(vertical), second.window_count(vertical)
+	first.size = 100 * a / (a + b)
+	second.size = 100 - first.size
+	window_equalize(first)
+	window_equalize(second)
+}
+
+// Number of windows side by side (or stacked when not vertical) in the tree
+func (vt *view_tree) window_count(vertical bool) int {
+	if vt.leaf != nil {
+		return 1
+	}
+	first, second := vt.top, vt.bottom
+	if vt.left != nil {
+		first, second = vt.left, vt.right
+	}
+	a, b := first.window_count(vertical), second.window_count(vertical)
+	if (vt.left != nil) == vertical {
+		return a + b
+	}
+	return max(a, b)
+}
+
+func (vt *view_tree) first_leaf() *view_tree {
+	for vt.leaf == nil {
+		if vt.left != nil {
+			vt = vt.left
+		} else {
+			vt = vt.top
+		}
+	}
+	return vt
+}
+
+func (vt *view_tree) leaves() []*view_tree {
+	if vt.leaf != nil {
+		return []*view_tree{vt}
+	}
+	if vt.left != nil {
+		return append(vt.left.leaves(), vt.right.leaves()...)
+	}
+	return append(vt.top.leaves(), vt.bottom.leaves()...)
+}
+
+type window_rect struct {
+	x, y, w, h int
+}
+
+// Position of every node of the tree as it is rendered
+func window_rects() map[*view_tree]*window_rect {
+	rects := map[*view_tree]*window_rect{}
+	x, y, w, h := window_area()
+	root_view_tree.layout(x, y, w, h, func(vt *view_tree, x, y, w, h int) {
+		rects[vt] = &window_rect{x, y, w, h}
+	})
+	return rects
+}
+
+func window_at(rects map[*view_tree]*window_rect, x, y int) *view_tree {
+	for vt, r := range rects {
+		if vt.leaf != nil && x >= r.x && x < r.x+r.w && y >= r.y && y < r.y+r.h {
+			return vt
+		}
+	}
+	return nil
+}
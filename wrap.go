@@ -0,0 +1,150 @@
+package main
+
+import (
+	runewidth "github.com/mattn/go-runewidth"
+)
+
+// With the wrap option lines longer than the window are continued on the
+// next screen rows, continuation rows start with wrap_indicator and with
+// wrap_at_word lines are only broken after white space. Without it the view
+// scrolls horizontally to follow the cursor, wrap is off by default.
+
+func init_wrap() {
+	bind_motion("g j", motion_exclusive, move_display_down)
+	bind_motion("g k", motion_exclusive, move_display_up)
+}
+
+// Number of screen cells a char takes, both when wrapping and rendering
+func char_width(r rune) int {
+	if r == '\t' {
+		return max(int(config_get_number("tab_width", nil)), 1)
+	}
+	return max(runewidth.RuneWidth(r), 1)
+}
+
+func display_width(line []rune) int {
+	w := 0
+	for _, r := range line {
+		w += char_width(r)
+	}
+	return w
+}
+
+// Index of the first char of each screen row a line takes when wrapped at
+// width, continuation rows lose indicator_width cells to the indicator
+func wrap_line(line []rune, width, indicator_width int, at_word bool) []int {
+	rows := []int{0}
+	avail := width
+	col := 0
+	for c := 0; c < len(line); c++ {
+		cw := char_width(line[c])
+		row_beg := rows[len(rows)-1]
+		if col+cw > avail && c > row_beg {
+			beg := c
+			if at_word {
+				for i := c; i > row_beg; i-- {
+					if is_space(line[i-1]) {
+						beg = i
+						break
+					}
+				}
+			}
+			rows = append(rows, beg)
+			avail = max(width-indicator_width, 1)
+			col = display_width(line[beg:c])
+		}
+		col += cw
+	}
+	return rows
+}
+
+// Row of a wrapped line the char at index c is on
+func wrap_row(rows []int, c int) int {
+	r := 0
+	for r+1 < len(rows) && rows[r+1] <= c {
+		r++
+	}
+	return r
+}
+
+func (v *view) text_width(w int) int {
+	return max(w-v.gutter_width(), 1)
+}
+
+// Rows line l takes in the view
+func (v *view) line_rows(l, w int) []int {
+	if !config_get_bool("wrap", v.buf) {
+		return []int{0}
+	}
+	indicator := []rune(config_get("wrap_indicator", v.buf))
+	return wrap_line(v.buf.get_line(l), v.text_width(w), display_width(indicator),
+		config_get_bool("wrap_at_word", v.buf))
+}
+
+// Screen rows taken by lines from..to-1 plus the rows of line to up to the
+// one the cursor is on
+func (v *view) rows_to_cursor(from, w int) int {
+	n := 0
+	for l := from; l < v.cursor.line; l++ {
+		n += len(v.line_rows(l, w))
+	}
+	return n + wrap_row(v.line_rows(v.cursor.line, w), v.cursor.char) + 1
+}
+
+// Moves by screen rows instead of lines when lines are wrapped
+func move_display(vt *view_tree, b *buffer, n int) {
+	v := vt.leaf
+	w := v.last_render_width
+	indicator_width := display_width([]rune(config_get("wrap_indicator", b)))
+	line, char := b.cursor.line, b.cursor.char
+
+	rows := v.line_rows(line, w)
+	r := wrap_row(rows, char)
+	col := display_width(b.get_line(line)[rows[r]:char])
+	if r > 0 {
+		col += indicator_width
+	}
+
+	step := 1
+	if n < 0 {
+		step = -1
+	}
+	for i := 0; i != n; i += step {
+		if r+step >= 0 && r+step < len(rows) {
+			r += step
+		} else if line+step >= 0 && line+step < b.line_count() {
+			line += step
+			rows = v.line_rows(line, w)
+			r = 0
+			if step < 0 {
+				r = len(rows) - 1
+			}
+		} else {
+			break
+		}
+	}
+
+	// Char at the same screen column on the new row
+	data := b.get_line(line)
+	end := len(data)
+	if r+1 < len(rows) {
+		end = rows[r+1] - 1
+	}
+	if r > 0 {
+		col -= indicator_width
+	}
+	c := rows[r]
+	for c < end && col-char_width(data[c]) >= 0 {
+		col -= char_width(data[c])
+		c++
+	}
+	b.move_to(c, line)
+}
+
+func move_display_down(vt *view_tree, b *buffer, kl *key_list) {
+	move_display(vt, b, kl.times())
+}
+
+func move_display_up(vt *view_tree, b *buffer, kl *key_list) {
+	move_display(vt, b, -kl.times())
+}